@@ -0,0 +1,170 @@
+// Package cache provides a size-bounded, in-memory LRU cache whose entries
+// expire after a per-entry TTL.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LRU is a least-recently-used cache safe for concurrent use. Expired
+// entries are no longer returned by Get but stay until evicted, so callers
+// can still fall back to them with GetStale. A nil LRU caches nothing.
+type LRU[K comparable, V any] struct {
+	mu    sync.Mutex
+	size  int
+	items map[K]*list.Element
+	order *list.List // Most recently used at the front
+
+	evictions atomic.Uint64
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// New returns a cache holding at most size entries, or nil when size is
+// not positive
+func New[K comparable, V any](size int) *LRU[K, V] {
+	if size <= 0 {
+		return nil
+	}
+	return &LRU[K, V]{size: size, items: make(map[K]*list.Element), order: list.New()}
+}
+
+// Get returns the value cached for key if it has not expired
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	return c.get(key, false)
+}
+
+// GetStale returns the value cached for key even if it has expired
+func (c *LRU[K, V]) GetStale(key K) (V, bool) {
+	return c.get(key, true)
+}
+
+func (c *LRU[K, V]) get(key K, stale bool) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	e := elem.Value.(*entry[K, V])
+	if !stale && time.Now().After(e.expires) {
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return e.value, true
+}
+
+// Peek returns the value cached for key even if it has expired, without
+// marking it as recently used
+func (c *LRU[K, V]) Peek(key K) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	return elem.Value.(*entry[K, V]).value, true
+}
+
+// Add caches value for key until ttl passes, evicting the least recently
+// used entry when the cache is full
+func (c *LRU[K, V]) Add(key K, value V, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry[K, V]).key)
+		c.evictions.Add(1)
+	}
+}
+
+// Remove drops key from the cache
+func (c *LRU[K, V]) Remove(key K) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// Purge drops every entry
+func (c *LRU[K, V]) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+}
+
+// Keys returns the cached keys, most recently used first
+func (c *LRU[K, V]) Keys() []K {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]K, 0, c.order.Len())
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*entry[K, V]).key)
+	}
+	return keys
+}
+
+// Len returns the number of cached entries, expired ones included
+func (c *LRU[K, V]) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Evictions returns how many entries were evicted to make room
+func (c *LRU[K, V]) Evictions() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.evictions.Load()
+}
@@ -0,0 +1,627 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Raw clicks must outlive the rollup job so none expire before being counted
+const minRawClickTTL = 24 * time.Hour
+
+// Config holds every setting of the server
+type Config struct {
+	// Addr is the address the HTTP server listens on
+	Addr string `yaml:"addr" toml:"addr"`
+
+	// ReadTimeout bounds reading a whole request, body included
+	ReadTimeout time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+
+	// ReadHeaderTimeout bounds reading request headers
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+
+	// WriteTimeout bounds writing a response. Streaming endpoints lift it.
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+
+	// IdleTimeout is how long idle keep-alive connections are kept open
+	IdleTimeout time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+
+	// ShutdownTimeout bounds draining requests and flushing background
+	// work on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// BaseURL is the public URL short codes are appended to
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+
+	// AllowedOrigins lists the origins allowed by CORS
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+
+	// URLSchemes lists the schemes link destinations may use
+	URLSchemes []string `yaml:"url_schemes" toml:"url_schemes"`
+
+	// MaxURLLength caps the length of link destinations
+	MaxURLLength int `yaml:"max_url_length" toml:"max_url_length"`
+
+	// AllowPrivateDestinations lets links point to loopback, private and
+	// local network hosts, for development
+	AllowPrivateDestinations bool `yaml:"allow_private_destinations" toml:"allow_private_destinations"`
+
+	// ResolveRedirects follows the redirects of new destinations and
+	// stores where they end, so links can't hide behind other shorteners
+	ResolveRedirects bool `yaml:"resolve_redirects" toml:"resolve_redirects"`
+
+	// RedirectMaxHops is the number of redirects followed before a
+	// destination is rejected
+	RedirectMaxHops int `yaml:"redirect_max_hops" toml:"redirect_max_hops"`
+
+	// RedirectResolveTimeout bounds following the redirects of a
+	// destination
+	RedirectResolveTimeout time.Duration `yaml:"redirect_resolve_timeout" toml:"redirect_resolve_timeout"`
+
+	// ThreatFeeds lists the malware and phishing feed files destinations
+	// are checked against. A "domains:", "urlhaus:" or "hashes:" prefix
+	// sets the format, which is otherwise guessed from the extension.
+	ThreatFeeds []string `yaml:"threat_feeds" toml:"threat_feeds"`
+
+	// ThreatFeedReloadInterval is how often feed files are checked for
+	// changes
+	ThreatFeedReloadInterval time.Duration `yaml:"threat_feed_reload_interval" toml:"threat_feed_reload_interval"`
+
+	// ThreatRecheckInterval is how often existing links are checked
+	// against the feeds again
+	ThreatRecheckInterval time.Duration `yaml:"threat_recheck_interval" toml:"threat_recheck_interval"`
+
+	// TrustedProxies lists the addresses and CIDR ranges of the proxies
+	// whose X-Forwarded-For header is believed
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// TrustedProxyPrefixes is TrustedProxies parsed by Validate
+	TrustedProxyPrefixes []netip.Prefix `yaml:"-" toml:"-"`
+
+	// MongoURI is the MongoDB connection string
+	MongoURI string `yaml:"mongodb_uri" toml:"mongodb_uri"`
+
+	// MongoMaxPoolSize caps the connections kept per MongoDB server
+	MongoMaxPoolSize uint64 `yaml:"mongodb_max_pool_size" toml:"mongodb_max_pool_size"`
+
+	// MongoMinPoolSize is the number of connections kept open when idle
+	MongoMinPoolSize uint64 `yaml:"mongodb_min_pool_size" toml:"mongodb_min_pool_size"`
+
+	// MongoConnectTimeout bounds opening a single connection
+	MongoConnectTimeout time.Duration `yaml:"mongodb_connect_timeout" toml:"mongodb_connect_timeout"`
+
+	// MongoServerSelectionTimeout is how long an operation waits for a
+	// usable server before failing
+	MongoServerSelectionTimeout time.Duration `yaml:"mongodb_server_selection_timeout" toml:"mongodb_server_selection_timeout"`
+
+	// MongoStartupTimeout is how long startup keeps retrying to reach
+	// MongoDB before giving up
+	MongoStartupTimeout time.Duration `yaml:"mongodb_startup_timeout" toml:"mongodb_startup_timeout"`
+
+	// QueryTimeout bounds a single lookup or write, such as resolving a
+	// short URL
+	QueryTimeout time.Duration `yaml:"query_timeout" toml:"query_timeout"`
+
+	// AnalyticsTimeout bounds a stats query or a pass of the rollup job
+	AnalyticsTimeout time.Duration `yaml:"analytics_timeout" toml:"analytics_timeout"`
+
+	// URLCacheSize is the number of short URL lookups cached in memory.
+	// Zero disables the cache.
+	URLCacheSize int `yaml:"url_cache_size" toml:"url_cache_size"`
+
+	// URLCacheTTL is how long a cached short URL is trusted
+	URLCacheTTL time.Duration `yaml:"url_cache_ttl" toml:"url_cache_ttl"`
+
+	// URLCacheNegativeTTL is how long an unknown short URL is remembered
+	URLCacheNegativeTTL time.Duration `yaml:"url_cache_negative_ttl" toml:"url_cache_negative_ttl"`
+
+	// URLCachePollInterval is how often cached links are checked against
+	// MongoDB when change streams are unavailable (standalone servers)
+	URLCachePollInterval time.Duration `yaml:"url_cache_poll_interval" toml:"url_cache_poll_interval"`
+
+	// URLFilter answers lookups of codes that were never created from an
+	// in-memory Bloom filter, without querying MongoDB. It is only used
+	// while change streams or the shared cache keep it up to date with the
+	// links other instances create.
+	URLFilter bool `yaml:"url_filter" toml:"url_filter"`
+
+	// URLFilterRebuildInterval is how often the Bloom filter is rebuilt
+	// from the links collection
+	URLFilterRebuildInterval time.Duration `yaml:"url_filter_rebuild_interval" toml:"url_filter_rebuild_interval"`
+
+	// KeyPoolSize is the number of pre-allocated short codes each instance
+	// keeps ready for new links
+	KeyPoolSize int `yaml:"key_pool_size" toml:"key_pool_size"`
+
+	// KeyBatchSize is the number of short codes allocated per round trip
+	KeyBatchSize int `yaml:"key_batch_size" toml:"key_batch_size"`
+
+	// InstanceID identifies this instance, for example to keep its change
+	// stream position across restarts. Defaults to the hostname.
+	InstanceID string `yaml:"instance_id" toml:"instance_id"`
+
+	// RedisURL points at the Redis-protocol server shared by every
+	// instance, as redis://[:password@]host:port/db. Empty disables the
+	// shared cache.
+	RedisURL string `yaml:"redis_url" toml:"redis_url"`
+
+	// RedisPoolSize caps the connections to the shared cache
+	RedisPoolSize int `yaml:"redis_pool_size" toml:"redis_pool_size"`
+
+	// RedisTimeout bounds every shared cache call. It is kept short since
+	// a slow cache is worse than none.
+	RedisTimeout time.Duration `yaml:"redis_timeout" toml:"redis_timeout"`
+
+	// RedisKeyPrefix namespaces the keys and channels of this service
+	RedisKeyPrefix string `yaml:"redis_key_prefix" toml:"redis_key_prefix"`
+
+	// RateLimitBackend keeps rate limit buckets in "memory", per instance,
+	// or in the "shared" cache, across instances
+	RateLimitBackend string `yaml:"rate_limit_backend" toml:"rate_limit_backend"`
+
+	// RateLimitPeriod is the period the rate limits are counted over
+	RateLimitPeriod time.Duration `yaml:"rate_limit_period" toml:"rate_limit_period"`
+
+	// RateLimitIP is the number of links an anonymous client IP may create
+	// per period. Zero disables the limit.
+	RateLimitIP int `yaml:"rate_limit_ip" toml:"rate_limit_ip"`
+
+	// RateLimitUser is the number of links an authenticated user may
+	// create per period. Zero disables the limit.
+	RateLimitUser int `yaml:"rate_limit_user" toml:"rate_limit_user"`
+
+	// RateLimitAPIKey is the number of links an API key may create per
+	// period. Zero disables the limit.
+	RateLimitAPIKey int `yaml:"rate_limit_api_key" toml:"rate_limit_api_key"`
+
+	// UserHeader names the header in which an authenticating proxy passes
+	// the user's ID. It is only believed from trusted proxies.
+	UserHeader string `yaml:"user_header" toml:"user_header"`
+
+	// APIKeys lists the keys clients may send in X-API-Key. Links created
+	// with a key can only be exported with the same key.
+	APIKeys []string `yaml:"api_keys" toml:"api_keys"`
+
+	// AdminToken is the bearer token of the admin endpoints, which also
+	// opens every link's exports. Empty disables the admin endpoints.
+	AdminToken string `yaml:"admin_token" toml:"admin_token"`
+
+	// ReportDisableThreshold is the number of visitors whose open reports
+	// disable a link until a moderator looks at it. Zero never disables.
+	ReportDisableThreshold int `yaml:"report_disable_threshold" toml:"report_disable_threshold"`
+
+	// Database holds short URLs, password-protected ones included, and
+	// analytics
+	Database string `yaml:"database" toml:"database"`
+
+	// VisitorHashSalt is mixed into visitor hashes used for unique counts
+	VisitorHashSalt string `yaml:"visitor_hash_salt" toml:"visitor_hash_salt"`
+
+	// RawClickTTL is how long raw click events are kept. Zero keeps them
+	// forever.
+	RawClickTTL time.Duration `yaml:"raw_click_ttl" toml:"raw_click_ttl"`
+
+	// AnalyticsRetention is how long click rollups and visitor sketches are
+	// kept. Zero keeps them forever. Raw clicks never outlive it.
+	AnalyticsRetention time.Duration `yaml:"analytics_retention" toml:"analytics_retention"`
+
+	// RollupInterval is how often raw clicks are rolled up into aggregates
+	RollupInterval time.Duration `yaml:"rollup_interval" toml:"rollup_interval"`
+
+	// AnonymizeIPs truncates client IPs before clicks are stored. Link
+	// owners can turn it on for their own links.
+	AnonymizeIPs bool `yaml:"anonymize_ips" toml:"anonymize_ips"`
+
+	// RespectDoNotTrack skips individual tracking for requests that send
+	// DNT: 1 or Sec-GPC: 1. Link owners can turn it on for their own links.
+	RespectDoNotTrack bool `yaml:"respect_dnt" toml:"respect_dnt"`
+
+	// LogFormat is the application log format, "json" or "text"
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+
+	// LogLevel is the minimum level logged: "debug", "info", "warn" or "error"
+	LogLevel string `yaml:"log_level" toml:"log_level"`
+
+	// AccessLog is the access log format: "json", "combined" or "off"
+	AccessLog string `yaml:"access_log" toml:"access_log"`
+
+	// TracesExporter selects where trace spans are sent: "none", "otlp",
+	// "stdout" or "file"
+	TracesExporter string `yaml:"traces_exporter" toml:"traces_exporter"`
+
+	// TracesFile is the file spans are appended to by the "file" exporter
+	TracesFile string `yaml:"traces_file" toml:"traces_file"`
+
+	// ServiceName identifies this service in traces
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+}
+
+// Default returns the configuration used when nothing overrides it
+func Default() *Config {
+	return &Config{
+		Addr:              ":8080",
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   20 * time.Second,
+		BaseURL:           "http://localhost:8080/",
+		AllowedOrigins: []string{
+			"http://localhost:3000",
+			"http://localhost:5173",
+		},
+		URLSchemes:                  []string{"http", "https"},
+		MaxURLLength:                2048,
+		RedirectMaxHops:             5,
+		RedirectResolveTimeout:      5 * time.Second,
+		ThreatFeedReloadInterval:    time.Minute,
+		ThreatRecheckInterval:       6 * time.Hour,
+		MongoMaxPoolSize:            100,
+		MongoConnectTimeout:         10 * time.Second,
+		MongoServerSelectionTimeout: 5 * time.Second,
+		MongoStartupTimeout:         2 * time.Minute,
+		QueryTimeout:                5 * time.Second,
+		AnalyticsTimeout:            30 * time.Second,
+		URLCacheSize:                10000,
+		URLCacheTTL:                 5 * time.Minute,
+		URLCacheNegativeTTL:         30 * time.Second,
+		URLCachePollInterval:        30 * time.Second,
+		URLFilter:                   true,
+		URLFilterRebuildInterval:    time.Hour,
+		KeyPoolSize:                 10000,
+		KeyBatchSize:                1000,
+		RedisPoolSize:               10,
+		RedisTimeout:                250 * time.Millisecond,
+		RedisKeyPrefix:              "urlshortener:",
+		RateLimitBackend:            "memory",
+		RateLimitPeriod:             time.Minute,
+		RateLimitIP:                 20,
+		RateLimitUser:               60,
+		RateLimitAPIKey:             600,
+		ReportDisableThreshold:      5,
+		Database:                    "urlShortener",
+		RollupInterval:              10 * time.Minute,
+		AnonymizeIPs:                true,
+		RespectDoNotTrack:           true,
+		LogFormat:                   "json",
+		LogLevel:                    "info",
+		AccessLog:                   "json",
+		TracesExporter:              "none",
+		TracesFile:                  "traces.json",
+		ServiceName:                 "url-shortener",
+	}
+}
+
+// setting binds one Config field to its environment variable and flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"addr", "ADDR", "address to listen on", (*stringValue)(&c.Addr)},
+		{"read-timeout", "READ_TIMEOUT", "maximum time to read a request", (*durationValue)(&c.ReadTimeout)},
+		{"read-header-timeout", "READ_HEADER_TIMEOUT", "maximum time to read request headers", (*durationValue)(&c.ReadHeaderTimeout)},
+		{"write-timeout", "WRITE_TIMEOUT", "maximum time to write a response", (*durationValue)(&c.WriteTimeout)},
+		{"idle-timeout", "IDLE_TIMEOUT", "how long idle connections are kept open", (*durationValue)(&c.IdleTimeout)},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "maximum time to drain requests on shutdown", (*durationValue)(&c.ShutdownTimeout)},
+		{"base-url", "BASE_URL", "public URL short codes are appended to", (*stringValue)(&c.BaseURL)},
+		{"allowed-origins", "ALLOWED_ORIGINS", "comma-separated origins allowed by CORS", (*listValue)(&c.AllowedOrigins)},
+		{"url-schemes", "URL_SCHEMES", "comma-separated schemes link destinations may use", (*listValue)(&c.URLSchemes)},
+		{"max-url-length", "MAX_URL_LENGTH", "maximum length of link destinations", (*intValue)(&c.MaxURLLength)},
+		{"allow-private-destinations", "ALLOW_PRIVATE_DESTINATIONS", "allow links to private and local network hosts", (*boolValue)(&c.AllowPrivateDestinations)},
+		{"resolve-redirects", "RESOLVE_REDIRECTS", "follow the redirects of new destinations and store where they end", (*boolValue)(&c.ResolveRedirects)},
+		{"redirect-max-hops", "REDIRECT_MAX_HOPS", "redirects followed before a destination is rejected", (*intValue)(&c.RedirectMaxHops)},
+		{"redirect-resolve-timeout", "REDIRECT_RESOLVE_TIMEOUT", "deadline for following the redirects of a destination", (*durationValue)(&c.RedirectResolveTimeout)},
+		{"threat-feeds", "THREAT_FEEDS", "comma-separated malware and phishing feed files", (*listValue)(&c.ThreatFeeds)},
+		{"threat-feed-reload-interval", "THREAT_FEED_RELOAD_INTERVAL", "how often feed files are checked for changes", (*durationValue)(&c.ThreatFeedReloadInterval)},
+		{"threat-recheck-interval", "THREAT_RECHECK_INTERVAL", "how often existing links are checked against the feeds", (*durationValue)(&c.ThreatRecheckInterval)},
+		{"trusted-proxies", "TRUSTED_PROXIES", "comma-separated proxy addresses or CIDRs whose X-Forwarded-For is believed", (*listValue)(&c.TrustedProxies)},
+		{"mongodb-uri", "MONGODB_URI", "MongoDB connection string", (*stringValue)(&c.MongoURI)},
+		{"mongodb-max-pool-size", "MONGODB_MAX_POOL_SIZE", "maximum connections per MongoDB server", (*uintValue)(&c.MongoMaxPoolSize)},
+		{"mongodb-min-pool-size", "MONGODB_MIN_POOL_SIZE", "connections kept open per MongoDB server", (*uintValue)(&c.MongoMinPoolSize)},
+		{"mongodb-connect-timeout", "MONGODB_CONNECT_TIMEOUT", "maximum time to open a MongoDB connection", (*durationValue)(&c.MongoConnectTimeout)},
+		{"mongodb-server-selection-timeout", "MONGODB_SERVER_SELECTION_TIMEOUT", "maximum time to wait for a usable MongoDB server", (*durationValue)(&c.MongoServerSelectionTimeout)},
+		{"mongodb-startup-timeout", "MONGODB_STARTUP_TIMEOUT", "how long startup retries reaching MongoDB", (*durationValue)(&c.MongoStartupTimeout)},
+		{"query-timeout", "QUERY_TIMEOUT", "deadline for a single lookup or write", (*durationValue)(&c.QueryTimeout)},
+		{"analytics-timeout", "ANALYTICS_TIMEOUT", "deadline for stats queries and rollup passes", (*durationValue)(&c.AnalyticsTimeout)},
+		{"url-cache-size", "URL_CACHE_SIZE", "short URL lookups cached in memory (0 disables)", (*intValue)(&c.URLCacheSize)},
+		{"url-cache-ttl", "URL_CACHE_TTL", "how long a cached short URL is trusted", (*durationValue)(&c.URLCacheTTL)},
+		{"url-cache-negative-ttl", "URL_CACHE_NEGATIVE_TTL", "how long an unknown short URL is remembered", (*durationValue)(&c.URLCacheNegativeTTL)},
+		{"url-cache-poll-interval", "URL_CACHE_POLL_INTERVAL", "how often cached links are rechecked without change streams", (*durationValue)(&c.URLCachePollInterval)},
+		{"url-filter", "URL_FILTER", "answer lookups of never-created codes from a Bloom filter", (*boolValue)(&c.URLFilter)},
+		{"url-filter-rebuild-interval", "URL_FILTER_REBUILD_INTERVAL", "how often the Bloom filter is rebuilt", (*durationValue)(&c.URLFilterRebuildInterval)},
+		{"key-pool-size", "KEY_POOL_SIZE", "short codes each instance keeps ready", (*intValue)(&c.KeyPoolSize)},
+		{"key-batch-size", "KEY_BATCH_SIZE", "short codes allocated per round trip", (*intValue)(&c.KeyBatchSize)},
+		{"instance-id", "INSTANCE_ID", "identifier of this instance (default hostname)", (*stringValue)(&c.InstanceID)},
+		{"redis-url", "REDIS_URL", "shared cache server, redis://host:port/db (empty disables)", (*stringValue)(&c.RedisURL)},
+		{"redis-pool-size", "REDIS_POOL_SIZE", "maximum connections to the shared cache", (*intValue)(&c.RedisPoolSize)},
+		{"redis-timeout", "REDIS_TIMEOUT", "deadline for shared cache calls", (*durationValue)(&c.RedisTimeout)},
+		{"redis-key-prefix", "REDIS_KEY_PREFIX", "prefix of shared cache keys and channels", (*stringValue)(&c.RedisKeyPrefix)},
+		{"rate-limit-backend", "RATE_LIMIT_BACKEND", "where rate limits are kept: memory or shared", (*stringValue)(&c.RateLimitBackend)},
+		{"rate-limit-period", "RATE_LIMIT_PERIOD", "period rate limits are counted over", (*durationValue)(&c.RateLimitPeriod)},
+		{"rate-limit-ip", "RATE_LIMIT_IP", "links an anonymous IP may create per period (0 disables)", (*intValue)(&c.RateLimitIP)},
+		{"rate-limit-user", "RATE_LIMIT_USER", "links a user may create per period (0 disables)", (*intValue)(&c.RateLimitUser)},
+		{"rate-limit-api-key", "RATE_LIMIT_API_KEY", "links an API key may create per period (0 disables)", (*intValue)(&c.RateLimitAPIKey)},
+		{"user-header", "USER_HEADER", "header carrying the user ID set by a trusted proxy", (*stringValue)(&c.UserHeader)},
+		{"api-keys", "API_KEYS", "comma-separated API keys accepted in X-API-Key", (*listValue)(&c.APIKeys)},
+		{"admin-token", "ADMIN_TOKEN", "bearer token of the admin endpoints (empty disables them)", (*stringValue)(&c.AdminToken)},
+		{"report-disable-threshold", "REPORT_DISABLE_THRESHOLD", "visitor reports that disable a link (0 never disables)", (*intValue)(&c.ReportDisableThreshold)},
+		{"database", "DATABASE", "database for short URLs and analytics", (*stringValue)(&c.Database)},
+		{"visitor-hash-salt", "VISITOR_HASH_SALT", "salt for unique visitor hashes", (*stringValue)(&c.VisitorHashSalt)},
+		{"raw-click-ttl", "RAW_CLICK_TTL", "how long raw clicks are kept (0 keeps them)", (*durationValue)(&c.RawClickTTL)},
+		{"analytics-retention", "ANALYTICS_RETENTION", "how long aggregated analytics are kept (0 keeps them)", (*durationValue)(&c.AnalyticsRetention)},
+		{"rollup-interval", "ROLLUP_INTERVAL", "how often raw clicks are rolled up", (*durationValue)(&c.RollupInterval)},
+		{"anonymize-ips", "ANONYMIZE_IPS", "truncate client IPs before storing clicks", (*boolValue)(&c.AnonymizeIPs)},
+		{"respect-dnt", "RESPECT_DNT", "skip individual tracking for DNT and Sec-GPC requests", (*boolValue)(&c.RespectDoNotTrack)},
+		{"log-format", "LOG_FORMAT", "log format: json or text", (*stringValue)(&c.LogFormat)},
+		{"log-level", "LOG_LEVEL", "minimum log level: debug, info, warn or error", (*stringValue)(&c.LogLevel)},
+		{"access-log", "ACCESS_LOG", "access log format: json, combined or off", (*stringValue)(&c.AccessLog)},
+		{"traces-exporter", "OTEL_TRACES_EXPORTER", "trace exporter: none, otlp, stdout or file", (*stringValue)(&c.TracesExporter)},
+		{"traces-file", "TRACES_FILE", "file written by the file trace exporter", (*stringValue)(&c.TracesFile)},
+		{"service-name", "OTEL_SERVICE_NAME", "service name reported in traces", (*stringValue)(&c.ServiceName)},
+	}
+}
+
+// Load builds the configuration from, in increasing order of precedence,
+// the defaults, an optional YAML or TOML file (-config or CONFIG_FILE),
+// environment variables (including those in an optional .env file) and
+// command-line flags
+func Load(args []string) (*Config, error) {
+	// A missing .env file is fine, real environment variables still apply
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env file: %v", err)
+	}
+
+	cfg := Default()
+
+	path := os.Getenv("CONFIG_FILE")
+	if value, ok := configFlag(args); ok {
+		path = value
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			if err := s.value.Set(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+		}
+	}
+
+	flags := flag.NewFlagSet("url-shortener", flag.ContinueOnError)
+	flags.String("config", path, "YAML or TOML config file")
+	for _, s := range cfg.settings() {
+		flags.Var(s.value, s.flag, s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configFlag finds the value of -config in args before the full flag set
+// is parsed, since the file has to be read before flags override it
+func configFlag(args []string) (string, bool) {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value, true
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// loadFile reads settings from a YAML or TOML file, chosen by extension
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration and fills in derived values
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if c.MongoURI == "" {
+		return errors.New("mongodb_uri is required (set MONGODB_URI)")
+	}
+	if c.MongoMaxPoolSize > 0 && c.MongoMinPoolSize > c.MongoMaxPoolSize {
+		return errors.New("mongodb_min_pool_size must not exceed mongodb_max_pool_size")
+	}
+	if c.MongoConnectTimeout <= 0 || c.MongoServerSelectionTimeout <= 0 || c.MongoStartupTimeout <= 0 {
+		return errors.New("mongodb timeouts must be positive")
+	}
+	if c.QueryTimeout <= 0 || c.AnalyticsTimeout <= 0 {
+		return errors.New("query_timeout and analytics_timeout must be positive")
+	}
+	if c.URLCacheSize < 0 {
+		return errors.New("url_cache_size must not be negative")
+	}
+	if c.URLCacheTTL <= 0 || c.URLCacheNegativeTTL <= 0 || c.URLCachePollInterval <= 0 {
+		return errors.New("url_cache_ttl, url_cache_negative_ttl and url_cache_poll_interval must be positive")
+	}
+	if c.URLFilterRebuildInterval <= 0 {
+		return errors.New("url_filter_rebuild_interval must be positive")
+	}
+	if c.KeyPoolSize <= 0 || c.KeyBatchSize <= 0 {
+		return errors.New("key_pool_size and key_batch_size must be positive")
+	}
+	if c.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("instance_id is not set and the hostname is unknown: %v", err)
+		}
+		c.InstanceID = hostname
+	}
+	if c.RedisPoolSize <= 0 || c.RedisTimeout <= 0 {
+		return errors.New("redis_pool_size and redis_timeout must be positive")
+	}
+	if len(c.URLSchemes) == 0 {
+		return errors.New("url_schemes must not be empty")
+	}
+	if c.MaxURLLength <= 0 {
+		return errors.New("max_url_length must be positive")
+	}
+	if c.RedirectMaxHops < 0 || c.RedirectResolveTimeout <= 0 {
+		return errors.New("redirect_max_hops must not be negative and redirect_resolve_timeout must be positive")
+	}
+	if c.ThreatFeedReloadInterval <= 0 || c.ThreatRecheckInterval <= 0 {
+		return errors.New("threat_feed_reload_interval and threat_recheck_interval must be positive")
+	}
+	if err := oneOf("rate_limit_backend", c.RateLimitBackend, "memory", "shared"); err != nil {
+		return err
+	}
+	if c.RateLimitBackend == "shared" && c.RedisURL == "" {
+		return errors.New("rate_limit_backend shared requires redis_url")
+	}
+	if c.RateLimitPeriod <= 0 {
+		return errors.New("rate_limit_period must be positive")
+	}
+	if c.RateLimitIP < 0 || c.RateLimitUser < 0 || c.RateLimitAPIKey < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < 16 {
+		return errors.New("admin_token must be at least 16 characters long")
+	}
+	if c.ReportDisableThreshold < 0 {
+		return errors.New("report_disable_threshold must not be negative")
+	}
+	c.TrustedProxyPrefixes = nil
+	for _, proxy := range c.TrustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		c.TrustedProxyPrefixes = append(c.TrustedProxyPrefixes, prefix)
+	}
+	if c.UserHeader != "" && len(c.TrustedProxyPrefixes) == 0 {
+		return errors.New("user_header requires trusted_proxies")
+	}
+
+	if c.Database == "" {
+		return errors.New("database is required")
+	}
+
+	base, err := url.Parse(c.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("base_url %q must be an absolute http or https URL", c.BaseURL)
+	}
+	if !strings.HasSuffix(c.BaseURL, "/") {
+		c.BaseURL += "/"
+	}
+
+	if err := oneOf("log_format", c.LogFormat, "json", "text"); err != nil {
+		return err
+	}
+	if err := oneOf("log_level", strings.ToLower(c.LogLevel), "debug", "info", "warn", "warning", "error"); err != nil {
+		return err
+	}
+	if err := oneOf("access_log", c.AccessLog, "json", "combined", "off"); err != nil {
+		return err
+	}
+	if err := oneOf("traces_exporter", c.TracesExporter, "none", "otlp", "stdout", "file"); err != nil {
+		return err
+	}
+
+	if c.ReadTimeout < 0 || c.ReadHeaderTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+
+	if c.RollupInterval <= 0 {
+		return errors.New("rollup_interval must be positive")
+	}
+	if c.RawClickTTL < 0 || c.AnalyticsRetention < 0 {
+		return errors.New("raw_click_ttl and analytics_retention must not be negative")
+	}
+	if c.AnalyticsRetention > 0 && c.AnalyticsRetention < minRawClickTTL {
+		return fmt.Errorf("analytics_retention must be at least %v", minRawClickTTL)
+	}
+	if c.RawClickTTL > 0 && c.RawClickTTL < minRawClickTTL {
+		return fmt.Errorf("raw_click_ttl must be at least %v", minRawClickTTL)
+	}
+	if c.AnalyticsRetention > 0 && (c.RawClickTTL == 0 || c.RawClickTTL > c.AnalyticsRetention) {
+		c.RawClickTTL = c.AnalyticsRetention
+	}
+
+	if c.VisitorHashSalt == "" {
+		// Without a fixed salt, unique counts restart whenever the server does
+		salt := make([]byte, 16)
+		_, _ = rand.Read(salt)
+		c.VisitorHashSalt = hex.EncodeToString(salt)
+		slog.Warn("VISITOR_HASH_SALT is not set, using a random salt for this run")
+	}
+	return nil
+}
+
+// parsePrefix parses a CIDR range, or a single address as a range of one
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func oneOf(name, value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value)
+}
@@ -3,70 +3,151 @@ package config
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"math/rand/v2"
+	"sync/atomic"
 	"time"
+	"url-short-backned/metrics"
 
-	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 var Client *mongo.Client
 
-// Load environment variables from the .env file
-func init() {
-	// Load the .env file
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+// Backoff between attempts to reach MongoDB at startup
+const (
+	initialConnectBackoff = 500 * time.Millisecond
+	maxConnectBackoff     = 15 * time.Second
+)
 
-	// Initialize the MongoDB client
-	err = InitMongoClient()
-	if err != nil {
-		log.Fatalf("Error initializing MongoDB client: %v", err)
-	}
-}
+// mongoAvailable is whether a writable MongoDB server is currently known
+var mongoAvailable atomic.Bool
 
-// InitMongoClient initializes the MongoDB client
-func InitMongoClient() error {
-	// Retrieve the MongoDB URI from the environment variable
-	mongoURI := os.Getenv("MONGODB_URI")
-	if mongoURI == "" {
-		return fmt.Errorf("MongoDB URI is missing from environment variables")
-	}	
+func init() {
+	metrics.NewGaugeFunc("urlshortener_mongo_available",
+		"Whether a writable MongoDB server is available (1) or the server is degraded (0).",
+		func() float64 {
+			if mongoAvailable.Load() {
+				return 1
+			}
+			return 0
+		})
+}
 
+// InitMongoClient connects to MongoDB, retrying with exponential backoff
+// until it answers, cfg.MongoStartupTimeout passes or ctx is cancelled
+func InitMongoClient(ctx context.Context, cfg *Config) error {
 	// Set client options
-	clientOptions := options.Client().ApplyURI(mongoURI).
-	SetConnectTimeout(60 * time.Second)
+	clientOptions := options.Client().ApplyURI(cfg.MongoURI).
+		SetMaxPoolSize(cfg.MongoMaxPoolSize).
+		SetMinPoolSize(cfg.MongoMinPoolSize).
+		SetConnectTimeout(cfg.MongoConnectTimeout).
+		SetServerSelectionTimeout(cfg.MongoServerSelectionTimeout).
+		SetMonitor(combineMonitors(metrics.MongoMonitor(), otelmongo.NewMonitor())).
+		SetServerMonitor(&event.ServerMonitor{TopologyDescriptionChanged: trackAvailability})
 
-	// Connect to MongoDB
-	client, err := mongo.Connect(context.Background(), clientOptions)
+	// Connect only validates the options, servers are dialled in the background
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return fmt.Errorf("failed to connect to MongoDB: %v", err)
 	}
 
-	// Check the connection
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("failed to ping MongoDB: %v", err)
+	// Wait for the primary to answer
+	deadline := time.Now().Add(cfg.MongoStartupTimeout)
+	backoff := initialConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err = client.Ping(ctx, readpref.Primary())
+		if err == nil {
+			break
+		}
+
+		// Sleep between half and all of the backoff, so restarted replicas
+		// don't retry in lockstep
+		sleep := backoff/2 + rand.N(backoff/2)
+		if ctx.Err() != nil || time.Now().Add(sleep).After(deadline) {
+			client.Disconnect(context.Background())
+			return fmt.Errorf("failed to reach MongoDB after %d attempts: %v", attempt, err)
+		}
+		slog.Warn("MongoDB is not reachable, retrying", "attempt", attempt, "retry_in", sleep, "error", err)
 
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
 	}
 
 	// Store the client in a global variable
 	Client = client
-	fmt.Println("Successfully connected to MongoDB!")
+	mongoAvailable.Store(true)
+	slog.Info("Successfully connected to MongoDB")
 	return nil
 }
 
-// CloseMongoClient closes the MongoDB connection
-func CloseMongoClient() {
-	if err := Client.Disconnect(context.Background()); err != nil {
-		log.Fatalf("Error disconnecting from MongoDB: %v", err)
+// MongoAvailable reports whether a writable MongoDB server is reachable.
+// While it isn't, the server runs degraded: writes are refused and
+// redirects are served from what is cached.
+func MongoAvailable() bool {
+	return mongoAvailable.Load()
+}
+
+// trackAvailability follows topology changes to keep MongoAvailable up to
+// date, logging when the server enters or leaves degraded mode
+func trackAvailability(evt *event.TopologyDescriptionChangedEvent) {
+	available := evt.NewDescription.HasWritableServer()
+	if mongoAvailable.Swap(available) == available {
+		return
+	}
+	if available {
+		slog.Info("MongoDB is reachable")
 	} else {
-		fmt.Println("Successfully disconnected from MongoDB!")
+		slog.Warn("MongoDB is unreachable, running in degraded mode")
+	}
+}
+
+// combineMonitors returns a command monitor that forwards every event to
+// each of the given monitors
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, evt)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, evt)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, evt)
+				}
+			}
+		},
 	}
 }
+
+// CloseMongoClient closes the MongoDB connection, waiting for in-use
+// connections until ctx expires
+func CloseMongoClient(ctx context.Context) {
+	if err := Client.Disconnect(ctx); err != nil {
+		slog.Error("Error disconnecting from MongoDB", "error", err)
+	} else {
+		slog.Info("Successfully disconnected from MongoDB")
+	}
+}
+
+// PingMongo checks that the primary is reachable
+func PingMongo(ctx context.Context) error {
+	return Client.Ping(ctx, readpref.Primary())
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"url-short-backned/models"
+	"url-short-backned/utils"
+
+	"github.com/gorilla/mux"
+)
+
+const dateLayout = "2006-01-02"
+
+// GetURLStats returns click analytics for a short URL. Bots are excluded
+// unless the request sets include_bots=true, and from/to (YYYY-MM-DD,
+// inclusive) restrict the range.
+func GetURLStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseStatsQuery(r)
+	if err != nil {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	stats, err := models.GetClickStats(r.Context(), query)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load stats")
+		return
+	}
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+// parseStatsQuery reads the short URL, date range and bot filter of an
+// analytics request
+func parseStatsQuery(r *http.Request) (models.StatsQuery, error) {
+	query := models.StatsQuery{ShortURL: mux.Vars(r)["shortURL"]}
+	params := r.URL.Query()
+
+	if value := params.Get("include_bots"); value != "" {
+		includeBots, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, errors.New("include_bots must be true or false")
+		}
+		query.IncludeBots = includeBots
+	}
+
+	if value := params.Get("from"); value != "" {
+		from, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return query, errors.New("from must be a date in YYYY-MM-DD format")
+		}
+		query.From = from
+	}
+
+	if value := params.Get("to"); value != "" {
+		to, err := time.Parse(dateLayout, value)
+		if err != nil {
+			return query, errors.New("to must be a date in YYYY-MM-DD format")
+		}
+		// The end date is inclusive
+		query.To = to.AddDate(0, 0, 1)
+	}
+
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, errors.New("from must not be after to")
+	}
+	return query, nil
+}
+
+// recordClick queues a click on shortURL made by the given request.
+// Visitors who opt out of tracking are counted without storing their IP,
+// user agent or referrer, and are left out of unique visitor counts. The
+// click worker applies the privacy settings of the link's owner on top.
+func recordClick(r *http.Request, shortURL string) {
+	agent := utils.ParseUserAgent(r.UserAgent())
+	click := models.Click{
+		ShortURL:    shortURL,
+		Timestamp:   time.Now(),
+		Browser:     agent.Browser,
+		OS:          agent.OS,
+		Device:      agent.Device,
+		IsBot:       agent.IsBot,
+		BotName:     agent.BotName,
+		BotCategory: agent.BotCategory,
+	}
+
+	optedOut := utils.DoNotTrack(r)
+	if !settings.RespectDoNotTrack || !optedOut {
+		ip := utils.ClientIP(r, settings.TrustedProxyPrefixes)
+		// Hash the full address so truncation doesn't merge visitors
+		click.VisitorHash = utils.VisitorHash(settings.VisitorHashSalt, ip, r.UserAgent())
+		if settings.AnonymizeIPs {
+			ip = utils.AnonymizeIP(ip)
+		}
+		click.IP = ip
+		click.UserAgent = r.UserAgent()
+		click.Referrer = r.Referer()
+		click.DoNotTrack = optedOut
+	}
+
+	models.TrackClick(click)
+}
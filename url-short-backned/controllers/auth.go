@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"url-short-backned/models"
+	"url-short-backned/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+// RequireAdmin only lets through requests bearing the configured admin
+// token. Without a token the routes it guards don't exist.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if settings.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !isAdmin(r) {
+			writeUnauthorized(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireOwner only lets through requests about a short URL made with the
+// API key or as the user that created it, or bearing the admin token.
+// Links created anonymously are only open to admins.
+func RequireOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, ok := requireIdentity(w, r)
+		if !ok {
+			return
+		}
+
+		linkOwner, err := models.GetURLOwner(r.Context(), mux.Vars(r)["shortURL"])
+		if err == models.ErrNotFound {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error":"Short URL not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, "Failed to look up URL")
+			return
+		}
+		if linkOwner != owner {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error":"Only the owner of this link may do this"}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireIdentity returns who the request is authenticated as, as
+// ratelimit.Owner does, writing an error response for anonymous requests
+func requireIdentity(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := ratelimit.Owner(r)
+	if owner == "" {
+		writeUnauthorized(w)
+		return "", false
+	}
+	return owner, true
+}
+
+// isAdmin reports whether the request bears the configured admin token
+func isAdmin(r *http.Request) bool {
+	if settings.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(settings.AdminToken)) == 1
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+}
@@ -0,0 +1,14 @@
+package controllers
+
+import (
+	"url-short-backned/config"
+)
+
+// settings is the configuration the handlers were initialised with
+var settings *config.Config
+
+// Init passes the server configuration to the handlers. It must be called
+// before the routes are served.
+func Init(cfg *config.Config) {
+	settings = cfg
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"url-short-backned/config"
+	"url-short-backned/models"
+)
+
+const (
+	// Seconds clients are asked to wait while the database is unreachable
+	unavailableRetryAfter = "5"
+
+	// Non-standard status recorded when the client went away before the
+	// response, as nginx does. Nobody reads it, but it keeps metrics and
+	// access logs honest.
+	statusClientClosedRequest = 499
+)
+
+// writeUnavailable answers 503 while the server runs without its database
+func writeUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", unavailableRetryAfter)
+	http.Error(w, `{"error":"Service temporarily unavailable"}`, http.StatusServiceUnavailable)
+}
+
+// writeStoreError answers a failed data layer call: 499 when the client
+// has gone away, 504 when the operation ran out of time, 503 when the
+// database could not be reached and 500 with msg otherwise
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	switch {
+	case r.Context().Err() != nil || errors.Is(err, context.Canceled):
+		slog.DebugContext(r.Context(), "Client went away during a store call", "error", err)
+		w.WriteHeader(statusClientClosedRequest)
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.WarnContext(r.Context(), "Store call timed out", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"The request timed out"}`, http.StatusGatewayTimeout)
+	case models.IsUnavailable(err) || !config.MongoAvailable():
+		writeUnavailable(w)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"`+msg+`"}`, http.StatusInternalServerError)
+	}
+}
+
+// fieldErrors maps request fields to what is wrong with them
+type fieldErrors map[string]string
+
+// writeFieldErrors answers 400 Bad Request, listing what is wrong with
+// each invalid field
+func writeFieldErrors(w http.ResponseWriter, fields fieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Invalid request",
+		"fields": fields,
+	})
+}
@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"url-short-backned/models"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+
+	// Rows written between flushes of a streamed export
+	exportFlushRows = 500
+)
+
+// exportedClick is one raw click row in an export. Visitors appear by
+// their salted hash rather than their IP.
+type exportedClick struct {
+	ShortURL    string    `json:"shortUrl"`
+	Timestamp   time.Time `json:"timestamp"`
+	Visitor     string    `json:"visitor,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Referrer    string    `json:"referrer,omitempty"`
+	Browser     string    `json:"browser"`
+	OS          string    `json:"os"`
+	Device      string    `json:"device"`
+	IsBot       bool      `json:"isBot"`
+	BotName     string    `json:"botName,omitempty"`
+	BotCategory string    `json:"botCategory,omitempty"`
+}
+
+// newExportedClick converts a stored click to an export row
+func newExportedClick(click models.Click) exportedClick {
+	return exportedClick{
+		ShortURL:    click.ShortURL,
+		Timestamp:   click.Timestamp.UTC(),
+		Visitor:     click.Visitor,
+		UserAgent:   click.UserAgent,
+		Referrer:    click.Referrer,
+		Browser:     click.Browser,
+		OS:          click.OS,
+		Device:      click.Device,
+		IsBot:       click.IsBot,
+		BotName:     click.BotName,
+		BotCategory: click.BotCategory,
+	}
+}
+
+// csvFields returns the click as a CSV row in clickCSVHeader order
+func (c exportedClick) csvFields() []string {
+	return []string{
+		c.ShortURL,
+		c.Timestamp.Format(time.RFC3339),
+		c.Visitor,
+		c.UserAgent,
+		c.Referrer,
+		c.Browser,
+		c.OS,
+		c.Device,
+		strconv.FormatBool(c.IsBot),
+		c.BotName,
+		c.BotCategory,
+	}
+}
+
+var clickCSVHeader = []string{
+	"short_url", "timestamp", "visitor", "user_agent", "referrer",
+	"browser", "os", "device", "is_bot", "bot_name", "bot_category",
+}
+
+// exportedDay is one daily stats row in an export
+type exportedDay struct {
+	ShortURL       string `json:"shortUrl"`
+	Date           string `json:"date"`
+	Clicks         int64  `json:"clicks"`
+	UniqueVisitors uint64 `json:"uniqueVisitors"`
+}
+
+var dayCSVHeader = []string{"short_url", "date", "clicks", "unique_visitors"}
+
+// rowWriter writes export rows as CSV or JSON Lines
+type rowWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	json    *json.Encoder
+	written int
+}
+
+// newRowWriter sets the export response headers and returns a writer for
+// the requested format
+func newRowWriter(w http.ResponseWriter, format, filename string, header []string) *rowWriter {
+	rw := &rowWriter{w: w}
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw.csv = csv.NewWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		rw.json = json.NewEncoder(w)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+
+	if rw.csv != nil {
+		rw.csv.Write(header)
+	}
+	return rw
+}
+
+// write emits a row, given both as a JSON value and as CSV fields
+func (rw *rowWriter) write(value interface{}, fields []string) error {
+	var err error
+	if rw.csv != nil {
+		for i, field := range fields {
+			fields[i] = escapeFormula(field)
+		}
+		err = rw.csv.Write(fields)
+	} else {
+		err = rw.json.Encode(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	rw.written++
+	if rw.written%exportFlushRows == 0 {
+		rw.flush()
+	}
+	return nil
+}
+
+func (rw *rowWriter) flush() {
+	if rw.csv != nil {
+		rw.csv.Flush()
+	}
+	if flusher, ok := rw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// escapeFormula keeps spreadsheets from running a CSV cell as a formula,
+// by prefixing cells that start like one with a single quote. User agents
+// and referrers come from visitors, so they can't be trusted.
+func escapeFormula(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+// parseExportFormat reads the format query parameter, defaulting to CSV
+func parseExportFormat(r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", formatCSV:
+		return formatCSV, true
+	case formatJSONL, "ndjson":
+		return formatJSONL, true
+	default:
+		return "", false
+	}
+}
+
+// ExportClicks streams the raw click events of a short URL as CSV or JSON
+// Lines. It accepts the same from, to and include_bots parameters as
+// GetURLStats, and is only open to the link's owner.
+func ExportClicks(w http.ResponseWriter, r *http.Request) {
+	query, format, ok := parseExportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Large exports can take longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	rows := newRowWriter(w, format, query.ShortURL+"-clicks", clickCSVHeader)
+	err := streamClickRows(r.Context(), rows, query)
+	rows.flush()
+
+	// Headers are already sent, so a failure can only cut the stream short.
+	// A client that went away is not worth logging.
+	if err != nil && r.Context().Err() == nil {
+		slog.ErrorContext(r.Context(), "Error exporting clicks", "short_url", query.ShortURL, "error", err)
+	}
+}
+
+// ExportStats returns the daily click and unique visitor counts of a short
+// URL as CSV or JSON Lines. It is only open to the link's owner.
+func ExportStats(w http.ResponseWriter, r *http.Request) {
+	query, format, ok := parseExportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := models.GetClickStats(r.Context(), query)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load stats")
+		return
+	}
+
+	rows := newRowWriter(w, format, query.ShortURL+"-stats", dayCSVHeader)
+	if err := writeDayRows(rows, query.ShortURL, stats.Daily); err != nil {
+		slog.ErrorContext(r.Context(), "Error exporting stats", "short_url", query.ShortURL, "error", err)
+		return
+	}
+	rows.flush()
+}
+
+// ExportOwnerClicks streams the raw click events of every link created
+// with the request's API key or by its user, link by link, as CSV or JSON
+// Lines. It accepts the same from, to and include_bots parameters as
+// GetURLStats.
+func ExportOwnerClicks(w http.ResponseWriter, r *http.Request) {
+	shortURLs, query, format, ok := parseOwnerExportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	rows := newRowWriter(w, format, "clicks", clickCSVHeader)
+	var err error
+	for _, shortURL := range shortURLs {
+		query.ShortURL = shortURL
+		if err = streamClickRows(r.Context(), rows, query); err != nil {
+			break
+		}
+	}
+	rows.flush()
+
+	if err != nil && r.Context().Err() == nil {
+		slog.ErrorContext(r.Context(), "Error exporting clicks", "short_url", query.ShortURL, "error", err)
+	}
+}
+
+// ExportOwnerStats returns the daily click and unique visitor counts of
+// every link created with the request's API key or by its user, as CSV or
+// JSON Lines
+func ExportOwnerStats(w http.ResponseWriter, r *http.Request) {
+	shortURLs, query, format, ok := parseOwnerExportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	rows := newRowWriter(w, format, "stats", dayCSVHeader)
+	for _, shortURL := range shortURLs {
+		query.ShortURL = shortURL
+		stats, err := models.GetClickStats(r.Context(), query)
+		if err == nil {
+			err = writeDayRows(rows, shortURL, stats.Daily)
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				slog.ErrorContext(r.Context(), "Error exporting stats", "short_url", shortURL, "error", err)
+			}
+			break
+		}
+	}
+	rows.flush()
+}
+
+// streamClickRows writes the raw clicks matching query to rows
+func streamClickRows(ctx context.Context, rows *rowWriter, query models.StatsQuery) error {
+	return models.StreamClicks(ctx, query, func(click models.Click) error {
+		row := newExportedClick(click)
+		return rows.write(row, row.csvFields())
+	})
+}
+
+// writeDayRows writes the daily stats of a short URL to rows
+func writeDayRows(rows *rowWriter, shortURL string, days []models.DailyStats) error {
+	for _, day := range days {
+		err := rows.write(exportedDay{
+			ShortURL:       shortURL,
+			Date:           day.Date,
+			Clicks:         day.Clicks,
+			UniqueVisitors: day.UniqueVisitors,
+		}, []string{
+			shortURL,
+			day.Date,
+			strconv.FormatInt(day.Clicks, 10),
+			strconv.FormatUint(day.UniqueVisitors, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOwnerExportRequest reads an export request covering every link of
+// the requester, returning their short URLs, and writes an error response
+// when the requester is anonymous or the request is invalid
+func parseOwnerExportRequest(w http.ResponseWriter, r *http.Request) ([]string, models.StatsQuery, string, bool) {
+	owner, ok := requireIdentity(w, r)
+	if !ok {
+		return nil, models.StatsQuery{}, "", false
+	}
+	query, format, ok := parseExportRequest(w, r)
+	if !ok {
+		return nil, query, "", false
+	}
+
+	shortURLs, err := models.OwnedURLs(r.Context(), owner)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load links")
+		return nil, query, "", false
+	}
+	return shortURLs, query, format, true
+}
+
+// parseExportRequest reads the stats query and format of an export
+// request, writing an error response when either is invalid
+func parseExportRequest(w http.ResponseWriter, r *http.Request) (models.StatsQuery, string, bool) {
+	query, err := parseStatsQuery(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+		return query, "", false
+	}
+
+	format, ok := parseExportFormat(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"format must be csv or jsonl"}`, http.StatusBadRequest)
+		return query, "", false
+	}
+	return query, format, true
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"url-short-backned/config"
+	"url-short-backned/models"
+)
+
+// Time allowed for all readiness checks together
+const readinessTimeout = 2 * time.Second
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// readinessCheck is one dependency of the server. When a check that isn't
+// critical fails, the server still takes traffic in degraded mode.
+type readinessCheck struct {
+	name     string
+	check    func(ctx context.Context) error
+	critical bool
+}
+
+var readinessChecks = []readinessCheck{
+	{"mongodb", config.PingMongo, false},
+	{"workers", checkWorkers, true},
+	{"cache", checkCache, true},
+}
+
+// Healthz reports that the process is up. It checks no dependencies, so
+// an orchestrator only restarts the server when it is truly stuck.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the server can serve traffic, with the result of
+// every dependency check. It answers 503 when a critical check fails, and
+// reports "degraded" when only others do.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	ready, degraded := true, false
+	checks := make(map[string]checkResult, len(readinessChecks))
+	for _, c := range readinessChecks {
+		start := time.Now()
+		err := c.check(ctx)
+		result := checkResult{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			if c.critical {
+				ready = false
+			} else {
+				degraded = true
+			}
+			result.Status = "failing"
+			result.Error = err.Error()
+		}
+		checks[c.name] = result
+	}
+
+	status, code := "ready", http.StatusOK
+	switch {
+	case !ready:
+		status, code = "not ready", http.StatusServiceUnavailable
+	case degraded:
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
+
+// checkWorkers fails when a background worker has exited
+func checkWorkers(ctx context.Context) error {
+	var stopped []string
+	for name, running := range models.WorkersRunning() {
+		if !running {
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 {
+		sort.Strings(stopped)
+		return fmt.Errorf("stopped: %s", strings.Join(stopped, ", "))
+	}
+	return nil
+}
+
+// checkCache fails until the URL cache has been warmed
+func checkCache(ctx context.Context) error {
+	if !models.URLCacheWarmed() {
+		return errors.New("warming up")
+	}
+	return nil
+}
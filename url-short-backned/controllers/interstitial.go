@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"url-short-backned/models"
+)
+
+// disabledMessages explains to visitors why a link was disabled, by reason
+var disabledMessages = map[string]string{
+	models.DisabledThreatFeed: "Its destination has been reported as malware or phishing. Visiting it could harm your device or steal your personal information.",
+	models.DisabledReports:    "Several visitors reported it as abusive, and it is awaiting review.",
+	models.DisabledModerator:  "It was disabled by a moderator.",
+	models.DisabledBanned:     "It was removed for abuse.",
+}
+
+var disabledPage = template.Must(template.New("disabled").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link disabled</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+h1 { color: #b00020; }
+code { word-break: break-all; background: #f4f4f4; padding: 0.1rem 0.3rem; }
+</style>
+</head>
+<body>
+<h1>This link has been disabled</h1>
+<p>{{.Message}}</p>
+<p>It pointed to <code>{{.Destination}}</code>.</p>
+</body>
+</html>
+`))
+
+// writeDisabledPage answers a visit to a disabled link with a warning page
+// rather than a redirect. The destination is shown but not linked.
+func writeDisabledPage(w http.ResponseWriter, r *http.Request, originalURL, reason string) {
+	message, ok := disabledMessages[reason]
+	if !ok {
+		message = "It was disabled by the operators of this service."
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(http.StatusForbidden)
+	err := disabledPage.Execute(w, struct{ Message, Destination string }{message, originalURL})
+	if err != nil && r.Context().Err() == nil {
+		slog.ErrorContext(r.Context(), "Error writing disabled link page", "error", err)
+	}
+}
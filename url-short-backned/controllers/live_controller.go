@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"url-short-backned/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Interval between comments that keep idle streams open through proxies
+const liveKeepAliveInterval = 15 * time.Second
+
+// liveClick is the payload of a click event on a live stream. Anyone who
+// knows a code can follow its stream, so it leaves out everything that
+// could identify a visitor or reveal where they came from.
+type liveClick struct {
+	ShortURL  string    `json:"shortUrl"`
+	Timestamp time.Time `json:"timestamp"`
+	Browser   string    `json:"browser"`
+	OS        string    `json:"os"`
+	Device    string    `json:"device"`
+	IsBot     bool      `json:"isBot"`
+	BotName   string    `json:"botName,omitempty"`
+}
+
+// StreamURLClicks streams clicks on a short URL as Server-Sent Events
+func StreamURLClicks(w http.ResponseWriter, r *http.Request) {
+	streamClicks(w, r, mux.Vars(r)["shortURL"])
+}
+
+// StreamAllClicks streams clicks on every short URL as Server-Sent Events.
+// There are no workspaces to narrow it to, so it is for admins only.
+func StreamAllClicks(w http.ResponseWriter, r *http.Request) {
+	streamClicks(w, r, "")
+}
+
+// streamClicks sends a "click" event for every click on shortURL (or on
+// all short URLs when empty) until the client disconnects. Bots are left
+// out unless include_bots=true. When the client falls behind, clicks are
+// dropped and a "dropped" event reports how many were missed.
+func streamClicks(w http.ResponseWriter, r *http.Request, shortURL string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"Streaming is not supported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	includeBots := false
+	if value := r.URL.Query().Get("include_bots"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error":"include_bots must be true or false"}`, http.StatusBadRequest)
+			return
+		}
+		includeBots = parsed
+	}
+
+	// Streams outlive the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	sub := models.SubscribeClicks(shortURL)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(liveKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case click, ok := <-sub.C:
+			if !ok {
+				return // Server is shutting down
+			}
+			if click.IsBot && !includeBots {
+				continue
+			}
+			if dropped := sub.Dropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", dropped)
+			}
+			data, err := json.Marshal(liveClick{
+				ShortURL:  click.ShortURL,
+				Timestamp: click.Timestamp.UTC(),
+				Browser:   click.Browser,
+				OS:        click.OS,
+				Device:    click.Device,
+				IsBot:     click.IsBot,
+				BotName:   click.BotName,
+			})
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: click\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -2,36 +2,62 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"url-short-backned/config"
 	"url-short-backned/models"
-	"url-short-backned/utils"
+	"url-short-backned/ratelimit"
+	"url-short-backned/urlcheck"
 )
 
 // CreateProtectedURL creates a password-protected URL and stores it in MongoDB
 func CreateProtectedURL(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	// Links can't be created while the database is unreachable
+	if !config.MongoAvailable() {
+		writeUnavailable(w)
+		return
+	}
+
 	var requestData struct {
 		URL      string `json:"url"`
 		Password string `json:"password"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil || requestData.URL == "" || len(requestData.Password) < 6 {
-		http.Error(w, `{"error":"Invalid request. Ensure URL is valid and password is at least 6 characters long."}`, http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	fields := fieldErrors{}
+	originalURL, err := checkDestination(r.Context(), requestData.URL)
+	if err != nil {
+		fields["url"] = err.Error()
+	}
+	if len(requestData.Password) < 6 {
+		fields["password"] = "must be at least 6 characters long"
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, fields)
 		return
 	}
 
-	// Generate a short URL
-	shortURL := utils.GenerateShortURL()
+	// Take a short URL from the pre-allocated pool
+	shortURL, err := models.NextKey(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to allocate a short URL")
+		return
+	}
 
 	// Store the password-protected URL in MongoDB
-	if err := models.StorePasswordProtectedURL(shortURL, requestData.URL, requestData.Password); err != nil {
-		http.Error(w, `{"error":"Failed to save URL"}`, http.StatusInternalServerError)
+	if err := models.StorePasswordProtectedURL(r.Context(), shortURL, originalURL, requestData.Password, ratelimit.Owner(r)); err != nil {
+		writeStoreError(w, r, err, "Failed to save URL")
 		return
 	}
 
 	// Respond with the short URL
-	json.NewEncoder(w).Encode(map[string]string{"shortUrl": "http://localhost:8080/" + shortURL})
+	json.NewEncoder(w).Encode(map[string]string{"shortUrl": settings.BaseURL + shortURL})
 }
 
 // RedirectProtectedURL redirects to the original URL if the correct password is provided
@@ -52,12 +78,33 @@ func RedirectProtectedURL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve the original URL from the database by matching short URL and password
-	originalURL, valid := models.RetrieveURLByPassword(shortURL, requestData.Password)
-	if !valid {
+	originalURL, err := models.RetrieveURLByPassword(r.Context(), shortURL, requestData.Password)
+	if err == models.ErrNotFound || err == models.ErrInvalidPassword {
+		redirectLookups.Inc("protected_redirect", "miss")
 		http.Error(w, `{"error":"Invalid password or URL not found"}`, http.StatusUnauthorized)
 		return
 	}
+	var disabled *models.DisabledError
+	if errors.As(err, &disabled) {
+		redirectLookups.Inc("protected_redirect", "disabled")
+		writeDisabledPage(w, r, originalURL, disabled.Reason)
+		return
+	}
+	if err != nil {
+		redirectLookups.Inc("protected_redirect", "error")
+		writeStoreError(w, r, err, "Failed to look up URL")
+		return
+	}
+	// The feeds may list the destination before the next recheck
+	// disables the link, so check now
+	if _, blocked := urlcheck.Blocked(originalURL); blocked {
+		redirectLookups.Inc("protected_redirect", "disabled")
+		writeDisabledPage(w, r, originalURL, models.DisabledThreatFeed)
+		return
+	}
+	redirectLookups.Inc("protected_redirect", "hit")
 
 	// Redirect to the original URL
+	recordClick(r, shortURL)
 	http.Redirect(w, r, originalURL, http.StatusFound)
 }
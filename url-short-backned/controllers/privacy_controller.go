@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+	"url-short-backned/models"
+
+	"github.com/gorilla/mux"
+)
+
+// visitorClick is a click in a visitor's data export
+type visitorClick struct {
+	exportedClick
+	IP string `json:"ip,omitempty"`
+}
+
+// ExportVisitorData returns every click and abuse report stored about the
+// visitor given by the ip and user_agent parameters, for data access
+// requests
+func ExportVisitorData(w http.ResponseWriter, r *http.Request) {
+	visitor, ok := parseVisitor(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := models.GetVisitorData(r.Context(), visitor)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load visitor data")
+		return
+	}
+
+	// Unlike link exports, these include the IP: it is the visitor's own
+	clicks := make([]visitorClick, len(data.Clicks))
+	for i, click := range data.Clicks {
+		clicks[i] = visitorClick{exportedClick: newExportedClick(click), IP: click.IP}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clicks":  clicks,
+		"reports": data.Reports,
+	})
+}
+
+// EraseVisitorData deletes every click and abuse report stored about the
+// visitor given by the ip and user_agent parameters, for erasure requests
+func EraseVisitorData(w http.ResponseWriter, r *http.Request) {
+	visitor, ok := parseVisitor(w, r)
+	if !ok {
+		return
+	}
+
+	erased, err := models.EraseVisitorData(r.Context(), visitor)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to erase visitor data")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Erased visitor data", "clicks", erased.Clicks, "reports", erased.Reports)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(erased)
+}
+
+// parseVisitor reads the visitor of a data request, writing an error
+// response when the parameters are invalid. While IPs are truncated, the
+// user agent is required, since other visitors share the truncated IP.
+func parseVisitor(w http.ResponseWriter, r *http.Request) (models.Visitor, bool) {
+	query := r.URL.Query()
+	fields := fieldErrors{}
+
+	addr, err := netip.ParseAddr(query.Get("ip"))
+	if err != nil {
+		fields["ip"] = "must be an IP address"
+	}
+	visitor := models.Visitor{IP: addr.Unmap().String(), UserAgent: query.Get("user_agent")}
+	if visitor.UserAgent == "" && settings.AnonymizeIPs {
+		fields["user_agent"] = "is required while IPs are truncated"
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, fields)
+		return visitor, false
+	}
+	return visitor, true
+}
+
+// ExportOwnerData returns everything stored about the links of an
+// account, for data access requests: the links, their raw clicks, rollups,
+// unique visitor counts and abuse reports. Clicks are streamed last, so
+// large accounts don't have to fit in memory.
+func ExportOwnerData(w http.ResponseWriter, r *http.Request) {
+	owner, ok := dataOwner(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := models.GetOwnerData(r.Context(), owner)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load account data")
+		return
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="account-data.json"`)
+	encoder := json.NewEncoder(w)
+	fmt.Fprint(w, `{"links":`)
+	encoder.Encode(data.Links)
+	fmt.Fprint(w, `,"reports":`)
+	encoder.Encode(data.Reports)
+	fmt.Fprint(w, `,"rollups":`)
+	encoder.Encode(data.Rollups)
+	fmt.Fprint(w, `,"uniqueVisitors":`)
+	encoder.Encode(data.UniqueVisitors)
+	fmt.Fprint(w, `,"clicks":[`)
+
+	separator := ""
+	for _, link := range data.Links {
+		query := models.StatsQuery{ShortURL: link.ShortURL, IncludeBots: true}
+		err = models.StreamClicks(r.Context(), query, func(click models.Click) error {
+			fmt.Fprint(w, separator)
+			separator = ","
+			return encoder.Encode(newExportedClick(click))
+		})
+		if err != nil {
+			// Headers are already sent, so the document is left unclosed
+			// for the client to notice
+			if r.Context().Err() == nil {
+				slog.ErrorContext(r.Context(), "Error exporting account data", "short_url", link.ShortURL, "error", err)
+			}
+			return
+		}
+	}
+	fmt.Fprint(w, "]}\n")
+}
+
+// EraseOwnerData deletes the links of an account with everything stored
+// about them, for erasure requests
+func EraseOwnerData(w http.ResponseWriter, r *http.Request) {
+	owner, ok := dataOwner(w, r)
+	if !ok {
+		return
+	}
+
+	erased, err := models.EraseOwnerData(r.Context(), owner)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to erase account data")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Erased account data", "links", erased.Links, "clicks", erased.Clicks,
+		"rollups", erased.Rollups, "visitor_sketches", erased.VisitorSketches, "reports", erased.Reports)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(erased)
+}
+
+// dataOwner returns the account a data request is about: the owner named
+// in the path on admin routes, and the requester's own account otherwise
+func dataOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if owner := mux.Vars(r)["owner"]; owner != "" {
+		return owner, true
+	}
+	return requireIdentity(w, r)
+}
+
+// GetOwnerPrivacy returns the privacy settings an account chose for its
+// links, and the ones their clicks are tracked with once the deployment's
+// are applied
+func GetOwnerPrivacy(w http.ResponseWriter, r *http.Request) {
+	owner, ok := dataOwner(w, r)
+	if !ok {
+		return
+	}
+
+	privacy, err := models.GetOwnerPrivacy(r.Context(), owner)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load privacy settings")
+		return
+	}
+	writeOwnerPrivacy(w, privacy)
+}
+
+// SetOwnerPrivacy replaces the privacy settings an account chose for its
+// links. They can turn on IP truncation and Do Not Track, and shorten how
+// long analytics are kept, but not loosen the deployment's settings.
+func SetOwnerPrivacy(w http.ResponseWriter, r *http.Request) {
+	owner, ok := dataOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var privacy models.Privacy
+	if err := json.NewDecoder(r.Body).Decode(&privacy); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if privacy.RetentionDays < 0 {
+		writeFieldErrors(w, fieldErrors{"retentionDays": "must not be negative"})
+		return
+	}
+
+	if err := models.SetOwnerPrivacy(r.Context(), owner, privacy); err != nil {
+		writeStoreError(w, r, err, "Failed to save privacy settings")
+		return
+	}
+	writeOwnerPrivacy(w, privacy)
+}
+
+// writeOwnerPrivacy responds with the privacy settings an account chose
+// and the ones in effect for its links
+func writeOwnerPrivacy(w http.ResponseWriter, privacy models.Privacy) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]models.Privacy{
+		"settings":  privacy,
+		"effective": privacy.Effective(),
+	})
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"url-short-backned/models"
+	"url-short-backned/utils"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Longest free-text explanation accepted with a report
+	maxReportDetails = 1000
+
+	defaultQueueLimit = 50
+	maxQueueLimit     = 100
+)
+
+// reportRequest is the body of an abuse report
+type reportRequest struct {
+	ShortURL string `json:"shortUrl"`
+	Reason   string `json:"reason"`
+	Details  string `json:"details"`
+}
+
+// ReportURL records a visitor's abuse report of a short URL. The short URL
+// may be given as its code or as the full short link.
+func ReportURL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var request reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	shortURL := strings.TrimPrefix(strings.TrimSpace(request.ShortURL), settings.BaseURL)
+	details := strings.TrimSpace(request.Details)
+	fields := fieldErrors{}
+	if shortURL == "" || strings.Contains(shortURL, "/") {
+		fields["shortUrl"] = "must be a short URL of this service"
+	}
+	if !slices.Contains(models.ReportReasons, request.Reason) {
+		fields["reason"] = "must be one of " + strings.Join(models.ReportReasons, ", ")
+	}
+	if len([]rune(details)) > maxReportDetails {
+		fields["details"] = "must be at most " + strconv.Itoa(maxReportDetails) + " characters"
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, fields)
+		return
+	}
+
+	// Reporters are told apart by their network, so one visitor can't
+	// reach the disable threshold alone
+	reporter := models.ReporterID(utils.ClientIP(r, settings.TrustedProxyPrefixes))
+
+	err := models.ReportURL(r.Context(), shortURL, reporter, request.Reason, details)
+	if err == models.ErrNotFound {
+		http.Error(w, `{"error":"Short URL not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to save report")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Thank you, the link will be reviewed"})
+}
+
+// ListReportedURLs returns the moderation queue: links with open reports,
+// most reported first. The limit parameter caps the number of links.
+func ListReportedURLs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := defaultQueueLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxQueueLimit {
+			http.Error(w, `{"error":"limit must be between 1 and `+strconv.Itoa(maxQueueLimit)+`"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	queue, err := models.ModerationQueue(r.Context(), limit)
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to load reports")
+		return
+	}
+	if queue == nil {
+		queue = []models.ReportedURL{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"urls": queue})
+}
+
+// ModerateURL disables, bans or restores a short URL and closes its open
+// reports. The body may carry a note, kept with the link.
+func ModerateURL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	shortURL, action := vars["shortURL"], vars["action"]
+
+	var request struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := models.ModerateURL(r.Context(), shortURL, action, strings.TrimSpace(request.Note))
+	if err == models.ErrNotFound {
+		http.Error(w, `{"error":"Short URL not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to moderate URL")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Moderated link", "short_url", shortURL, "action", action)
+	json.NewEncoder(w).Encode(map[string]string{"shortUrl": shortURL, "action": action})
+}
@@ -1,39 +1,150 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"url-short-backned/config"
+	"url-short-backned/metrics"
 	"url-short-backned/models"
-	"url-short-backned/utils"
+	"url-short-backned/ratelimit"
+	"url-short-backned/urlcheck"
+)
+
+var redirectLookups = metrics.NewCounterVec("urlshortener_redirect_lookups_total",
+	"Short URL lookups made by redirects, by route and result (hit, miss, disabled or error).", "route", "result")
+
+var rejectedDestinations = metrics.NewCounterVec("urlshortener_rejected_destinations_total",
+	"Link destinations rejected at creation, by reason (invalid, blocked, banned or redirects).", "reason")
+
+// Resolved once, since RedirectURL is the hottest path
+var (
+	redirectHits     = redirectLookups.With("redirect", "hit")
+	redirectMisses   = redirectLookups.With("redirect", "miss")
+	redirectErrors   = redirectLookups.With("redirect", "error")
+	redirectDisabled = redirectLookups.With("redirect", "disabled")
 )
 
 func ShortenURL(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	// Links can't be created while the database is unreachable
+	if !config.MongoAvailable() {
+		writeUnavailable(w)
+		return
+	}
+
 	var requestData map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil || requestData["url"] == "" {
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
 		return
 	}
 
-	originalURL := requestData["url"]
-	shortURL := utils.GenerateShortURL()
+	originalURL, err := checkDestination(r.Context(), requestData["url"])
+	if err != nil {
+		writeFieldErrors(w, fieldErrors{"url": err.Error()})
+		return
+	}
+
+	shortURL, err := models.NextKey(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err, "Failed to allocate a short URL")
+		return
+	}
 
-	if err := models.SaveURL(shortURL, originalURL); err != nil {
-		http.Error(w, `{"error":"Failed to save URL"}`, http.StatusInternalServerError)
+	if err := models.SaveURL(r.Context(), shortURL, originalURL, ratelimit.Owner(r)); err != nil {
+		writeStoreError(w, r, err, "Failed to save URL")
 		return
 	}
 
-	responseData := map[string]string{"shortUrl": "http://localhost:8080/" + shortURL}
+	responseData := map[string]string{"shortUrl": settings.BaseURL + shortURL, "destination": originalURL}
 	json.NewEncoder(w).Encode(responseData)
 }
 
+// RedirectURL redirects a short URL to its original URL. It is served by
+// FastRedirects for most requests, so it must not depend on mux.
 func RedirectURL(w http.ResponseWriter, r *http.Request) {
 	shortURL := r.URL.Path[1:]
-	originalURL, exists := models.GetURL(shortURL)
-	if !exists {
+	originalURL, err := models.GetURL(r.Context(), shortURL)
+	if err == models.ErrNotFound {
+		redirectMisses.Inc()
 		http.Error(w, "URL not found", http.StatusNotFound)
 		return
 	}
-	http.Redirect(w, r, originalURL, http.StatusFound)
+	var disabled *models.DisabledError
+	if errors.As(err, &disabled) {
+		redirectDisabled.Inc()
+		writeDisabledPage(w, r, originalURL, disabled.Reason)
+		return
+	}
+	if err != nil {
+		redirectErrors.Inc()
+		writeStoreError(w, r, err, "Failed to look up URL")
+		return
+	}
+	redirectHits.Inc()
+	recordClick(r, shortURL)
+
+	// Unlike http.Redirect, don't render an HTML body nobody reads
+	w.Header()["Location"] = []string{originalURL}
+	w.WriteHeader(http.StatusFound)
+}
+
+// checkDestination normalises the destination of a new link and checks it
+// against the threat feeds. When redirect resolution is on, it returns
+// where the destination's redirects end instead. Its errors are meant for
+// the user.
+func checkDestination(ctx context.Context, raw string) (string, error) {
+	originalURL, err := urlcheck.Normalize(raw)
+	if err != nil {
+		rejectedDestinations.Inc("invalid")
+		return "", err
+	}
+	if feed, blocked := urlcheck.Blocked(originalURL); blocked {
+		rejectedDestinations.Inc("blocked")
+		slog.Warn("Rejected link to a destination listed in a threat feed", "url", originalURL, "feed", feed)
+		return "", errors.New("points to a site reported for malware or phishing")
+	}
+	if err := checkBannedHost(ctx, originalURL); err != nil {
+		return "", err
+	}
+	if !settings.ResolveRedirects {
+		return originalURL, nil
+	}
+
+	final, err := urlcheck.Resolve(ctx, originalURL)
+	var chainErr *urlcheck.ChainError
+	if errors.As(err, &chainErr) {
+		rejectedDestinations.Inc("redirects")
+		return "", err
+	}
+	if err != nil {
+		// The destination may only be down for now, so keep it as given
+		slog.DebugContext(ctx, "Error resolving redirects", "url", originalURL, "error", err)
+		return originalURL, nil
+	}
+	if final != originalURL {
+		if err := checkBannedHost(ctx, final); err != nil {
+			return "", err
+		}
+	}
+	return final, nil
+}
+
+// checkBannedHost rejects destinations on hosts banned by moderators. A
+// failed check lets the destination through, since creating the link
+// fails anyway when MongoDB is down.
+func checkBannedHost(ctx context.Context, destination string) error {
+	banned, err := models.IsBannedHost(ctx, destination)
+	if err != nil {
+		slog.WarnContext(ctx, "Error checking banned hosts", "url", destination, "error", err)
+		return nil
+	}
+	if banned {
+		rejectedDestinations.Inc("banned")
+		return errors.New("points to a site banned for abuse")
+	}
+	return nil
 }
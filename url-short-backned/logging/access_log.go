@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"url-short-backned/config"
+	"url-short-backned/utils"
+)
+
+// Supported values of the ACCESS_LOG setting
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+	AccessLogOff      = "off"
+)
+
+// responseRecorder captures the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working through the recorder
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+var (
+	combinedMu  sync.Mutex
+	combinedOut io.Writer = os.Stdout
+)
+
+// AccessLog returns middleware that logs one line per request, either as a
+// structured slog record or in the Apache combined log format. Client IPs
+// are truncated when the configuration anonymises IPs.
+func AccessLog(cfg *config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if cfg.AccessLog == AccessLogOff {
+			return next
+		}
+		return accessLogHandler(cfg, next)
+	}
+}
+
+func accessLogHandler(cfg *config.Config, next http.Handler) http.Handler {
+	format := cfg.AccessLog
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+
+		clientIP := utils.ClientIP(r, cfg.TrustedProxyPrefixes)
+		if cfg.AnonymizeIPs {
+			clientIP = utils.AnonymizeIP(clientIP)
+		}
+
+		if format == AccessLogCombined {
+			writeCombined(r, recorder, start, clientIP)
+			return
+		}
+
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int64("bytes", recorder.bytes),
+			slog.Duration("duration", duration),
+			slog.String("client_ip", clientIP),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("referer", r.Referer()),
+		)
+	})
+}
+
+// writeCombined writes a line in the Apache combined log format followed
+// by the request ID
+func writeCombined(r *http.Request, recorder *responseRecorder, start time.Time, clientIP string) {
+	host := clientIP
+	if host == "" {
+		host = "-"
+	}
+
+	size := "-"
+	if recorder.bytes > 0 {
+		size = fmt.Sprint(recorder.bytes)
+	}
+	referer := r.Referer()
+	if referer == "" {
+		referer = "-"
+	}
+
+	line := fmt.Sprintf("%s - - [%s] %q %d %s %q %q %s\n",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		recorder.status,
+		size,
+		referer,
+		r.UserAgent(),
+		RequestIDFromContext(r.Context()),
+	)
+
+	combinedMu.Lock()
+	defer combinedMu.Unlock()
+	io.WriteString(combinedOut, line)
+}
@@ -1,40 +1,184 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"url-short-backned/config"
+	"url-short-backned/controllers"
+	"url-short-backned/logging"
+	"url-short-backned/models"
+	"url-short-backned/ratelimit"
 	"url-short-backned/routes"
+	"url-short-backned/sharedcache"
+	"url-short-backned/tracing"
+	"url-short-backned/urlcheck"
 
 	"github.com/rs/cors"
 )
 
 func main() {
+	if err := run(); err != nil {
+		fatal("Server failed", err)
+	}
+}
+
+// run starts the server and blocks until it is interrupted, then drains
+// in-flight requests, flushes background work and closes the database
+func run() error {
+	// Load the configuration from file, environment and flags
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+
+	// Set up structured logging
+	logging.Init(cfg)
+
+	// Stop on Ctrl-C or when the orchestrator asks us to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize MongoDB client
-	err := config.InitMongoClient()
+	err = config.InitMongoClient(ctx, cfg)
 	if err != nil {
-		log.Fatalf("Error initializing MongoDB: %v", err)
+		return err
 	}
-	defer config.CloseMongoClient()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		config.CloseMongoClient(ctx)
+	}()
+
+	// Connect to the cache shared with other instances, if any
+	if err := sharedcache.Init(ctx, cfg); err != nil {
+		return err
+	}
+	defer sharedcache.Close()
+
+	// Pass the configuration to the data layer and handlers
+	models.Init(cfg)
+	controllers.Init(cfg)
+	ratelimit.Init(cfg)
+	if err := urlcheck.Init(cfg); err != nil {
+		return fmt.Errorf("failed to load threat feeds: %v", err)
+	}
+
+	// Set up tracing and trace context propagation
+	shutdownTracing, err := tracing.Init(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
+
+	// Create the indexes used by analytics
+	if err := models.EnsureIndexes(ctx); err != nil {
+		return fmt.Errorf("failed to create indexes: %v", err)
+	}
+
+	// Start writing tracked clicks in the background
+	models.StartClickWorker()
+
+	// Roll raw clicks up into hourly and daily aggregates
+	models.StartRollupWorker()
+
+	// Drop links other instances change from the local cache
+	models.StartInvalidationListener()
+
+	// Follow changes to the links collection, whoever makes them
+	models.StartURLChangeWatcher()
+
+	// Turn away lookups of codes that were never created
+	models.StartURLFilterWorker()
+
+	// Keep short codes pre-allocated for new links
+	models.StartKeyPool()
+
+	// Disable links whose destinations the threat feeds list
+	models.StartThreatFeedWorker()
+
+	// Preload the busiest links, /readyz waits for it
+	go models.WarmURLCache(ctx)
 
 	// Initialize the base router from SetupRoutes
-	baseRouter := routes.SetupRoutes()
+	baseRouter := routes.SetupRoutes(cfg)
 
 	// Initialize password-related routes on the same router
 	routes.InitializePasswordRoutes(baseRouter)
 
 	// Set up CORS middleware
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{
-			"http://localhost:3000",
-			"http://localhost:5173",
-		},
+		AllowedOrigins: cfg.AllowedOrigins,
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "traceparent", "tracestate", logging.RequestIDHeader, ratelimit.APIKeyHeader},
+		ExposedHeaders: []string{
+			logging.RequestIDHeader,
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After",
+		},
 		AllowCredentials: true,
 	})
 
-	// Start the server with CORS middleware applied to the base router
-	log.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", corsHandler.Handler(baseRouter)))
+	// Tag every request with an ID and log it, then apply CORS
+	handler := logging.RequestID(logging.AccessLog(cfg)(corsHandler.Handler(routes.FastRedirects(baseRouter))))
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	// Live streams never finish on their own, so end them when draining
+	server.RegisterOnShutdown(models.CloseClickSubscriptions)
+
+	// Start the server
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server is running", "addr", cfg.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+		stop()
+		slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and wait for in-flight requests
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error draining requests", "error", err)
+	}
+
+	// Write the clicks those requests queued
+	if err := models.StopWorkers(shutdownCtx); err != nil {
+		slog.Error("Error stopping background workers", "error", err)
+	}
+
+	slog.Info("Server stopped")
+	return nil
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
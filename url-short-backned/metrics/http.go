@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	httpRequests = NewCounterVec("urlshortener_http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "code")
+	httpDuration = NewHistogramVec("urlshortener_http_request_duration_seconds",
+		"HTTP request latency in seconds, by route and method.", DefaultBuckets, "route", "method")
+)
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Middleware records request counts and latency for every matched route,
+// labelled by the route's name or, failing that, its path template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		observe(routeLabel(r), r.Method, recorder.status, start)
+	})
+}
+
+// Route records request counts and latency like Middleware, under a fixed
+// route label, for handlers served outside the router
+func Route(route string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		observe(route, r.Method, recorder.status, start)
+	})
+}
+
+func observe(route, method string, status int, start time.Time) {
+	httpRequests.Inc(route, method, strconv.Itoa(status))
+	httpDuration.Observe(time.Since(start).Seconds(), route, method)
+}
+
+func routeLabel(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if template, err := route.GetPathTemplate(); err == nil {
+		return template
+	}
+	return "unknown"
+}
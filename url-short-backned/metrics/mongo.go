@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	mongoDuration = NewHistogramVec("urlshortener_mongo_operation_duration_seconds",
+		"MongoDB command latency in seconds, by command.", DefaultBuckets, "command")
+	mongoErrors = NewCounterVec("urlshortener_mongo_operation_errors_total",
+		"MongoDB commands that failed, by command.", "command")
+)
+
+// MongoMonitor returns a command monitor that records the latency and
+// failures of every MongoDB command
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, evt *event.CommandSucceededEvent) {
+			mongoDuration.Observe(evt.Duration.Seconds(), evt.CommandName)
+		},
+		Failed: func(_ context.Context, evt *event.CommandFailedEvent) {
+			mongoDuration.Observe(evt.Duration.Seconds(), evt.CommandName)
+			mongoErrors.Inc(evt.CommandName)
+		},
+	}
+}
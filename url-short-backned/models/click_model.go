@@ -0,0 +1,394 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+	"url-short-backned/metrics"
+	"url-short-backned/tracing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var clickCollection *mongo.Collection
+
+const (
+	clickQueueSize     = 4096
+	clickBatchSize     = 100
+	clickFlushInterval = time.Second
+)
+
+// Click is a single visit to a short URL
+type Click struct {
+	ShortURL    string    `bson:"short_url"`
+	Timestamp   time.Time `bson:"timestamp"`
+	IP          string    `bson:"ip,omitempty"`
+	UserAgent   string    `bson:"user_agent,omitempty"`
+	Referrer    string    `bson:"referrer,omitempty"`
+	Browser     string    `bson:"browser"`
+	OS          string    `bson:"os"`
+	Device      string    `bson:"device"`
+	IsBot       bool      `bson:"is_bot"`
+	BotName     string    `bson:"bot_name,omitempty"`
+	BotCategory string    `bson:"bot_category,omitempty"`
+
+	// VisitorHash identifies the visitor in unique counts. It is zero for
+	// visitors who opted out of tracking.
+	VisitorHash uint64 `bson:"-"`
+
+	// DoNotTrack is set for visitors who opted out of tracking while the
+	// deployment doesn't honour it, so the link's owner decides. It is
+	// never stored.
+	DoNotTrack bool `bson:"-"`
+
+	// Visitor is VisitorHash as stored, so data requests can find a
+	// visitor's clicks after their IP was truncated
+	Visitor string `bson:"visitor,omitempty"`
+}
+
+// StatsQuery selects the clicks summarised by GetClickStats. Zero From or
+// To times leave that end of the range open.
+type StatsQuery struct {
+	ShortURL    string
+	From        time.Time
+	To          time.Time
+	IncludeBots bool
+}
+
+// ClickStats summarises the clicks recorded for a short URL
+type ClickStats struct {
+	ShortURL       string           `json:"shortUrl"`
+	TotalClicks    int64            `json:"totalClicks"`
+	BotClicks      int64            `json:"botClicks"`
+	UniqueVisitors uint64           `json:"uniqueVisitors"`
+	Browsers       map[string]int64 `json:"browsers"`
+	OS             map[string]int64 `json:"os"`
+	Devices        map[string]int64 `json:"devices"`
+	Daily          []DailyStats     `json:"daily"`
+}
+
+// DailyStats holds the click and unique visitor counts of one UTC day
+type DailyStats struct {
+	Date           string `json:"date"`
+	Clicks         int64  `json:"clicks"`
+	UniqueVisitors uint64 `json:"uniqueVisitors"`
+}
+
+var (
+	clickQueue    = make(chan Click, clickQueueSize)
+	droppedClicks atomic.Int64
+)
+
+func init() {
+	metrics.NewGaugeFunc("urlshortener_click_queue_depth",
+		"Clicks waiting to be written to MongoDB.",
+		func() float64 { return float64(len(clickQueue)) })
+	metrics.NewCounterFunc("urlshortener_clicks_dropped_total",
+		"Clicks dropped because the click queue was full.",
+		func() float64 { return float64(droppedClicks.Load()) })
+}
+
+// TrackClick publishes a click to live subscribers and queues it for
+// storage without blocking the redirect. Clicks are dropped when the queue
+// is full.
+func TrackClick(click Click) {
+	publishClick(click)
+
+	select {
+	case clickQueue <- click:
+	default:
+		droppedClicks.Add(1)
+	}
+}
+
+// StartClickWorker starts the background goroutine that writes queued
+// clicks to MongoDB in batches. When stopped it writes whatever is still
+// queued before returning.
+func StartClickWorker() {
+	startWorker("click", func(stop <-chan struct{}) {
+		ticker := time.NewTicker(clickFlushInterval)
+		defer ticker.Stop()
+
+		batch := make([]Click, 0, clickBatchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			ctx, cancel := withQueryTimeout(context.Background())
+			applyOwnerPrivacy(ctx, batch)
+			cancel()
+
+			docs := make([]interface{}, len(batch))
+			for i, click := range batch {
+				if click.VisitorHash != 0 {
+					click.Visitor = visitorID(click.VisitorHash)
+				}
+				docs[i] = click
+			}
+			ctx, cancel = withQueryTimeout(context.Background())
+			if _, err := clickCollection.InsertMany(ctx, docs); err != nil {
+				slog.Error("Error saving clicks", "count", len(batch), "error", err)
+			}
+			cancel()
+			addVisitors(batch)
+			batch = batch[:0]
+		}
+		add := func(click Click) {
+			batch = append(batch, click)
+			if len(batch) >= clickBatchSize {
+				flush()
+			}
+		}
+
+		for {
+			select {
+			case click := <-clickQueue:
+				add(click)
+			case <-ticker.C:
+				flush()
+			case <-stop:
+				// Drain the queue before exiting
+				for {
+					select {
+					case click := <-clickQueue:
+						add(click)
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+// clickCounts accumulates click totals and breakdowns from raw clicks and
+// rollups alike
+type clickCounts struct {
+	total    int64
+	bots     int64
+	browsers map[string]int64
+	os       map[string]int64
+	devices  map[string]int64
+	daily    map[string]int64
+}
+
+func newClickCounts() *clickCounts {
+	return &clickCounts{
+		browsers: map[string]int64{},
+		os:       map[string]int64{},
+		devices:  map[string]int64{},
+		daily:    map[string]int64{},
+	}
+}
+
+// GetClickStats returns click totals, unique visitors and browser, OS,
+// device and daily breakdowns for a short URL. Ranges already rolled up
+// are read from the rollups and only the newer tail from raw clicks.
+func GetClickStats(ctx context.Context, query StatsQuery) (stats *ClickStats, err error) {
+	ctx, span := tracing.Start(ctx, "models.GetClickStats", attribute.String("short_url", query.ShortURL))
+	defer tracing.End(span, &err)
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	counts := newClickCounts()
+
+	rolledUntil, err := getRolledUntil(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rawFrom := query.From
+	if !rolledUntil.IsZero() && (query.From.IsZero() || query.From.Before(rolledUntil)) {
+		rolledTo := rolledUntil
+		if !query.To.IsZero() && query.To.Before(rolledTo) {
+			rolledTo = query.To
+		}
+		if err := addRolledClicks(ctx, counts, query, query.From, rolledTo); err != nil {
+			return nil, err
+		}
+		rawFrom = rolledUntil
+	}
+
+	if query.To.IsZero() || rawFrom.Before(query.To) {
+		if err := addRawClicks(ctx, counts, query, rawFrom, query.To); err != nil {
+			return nil, err
+		}
+	}
+
+	stats = &ClickStats{
+		ShortURL:    query.ShortURL,
+		TotalClicks: counts.total,
+		BotClicks:   counts.bots,
+		Browsers:    counts.browsers,
+		OS:          counts.os,
+		Devices:     counts.devices,
+		Daily:       []DailyStats{},
+	}
+
+	// Unique visitors come from the daily sketches covering the same range
+	fromDay, toDay := "", ""
+	if !query.From.IsZero() {
+		fromDay = query.From.UTC().Format(dayLayout)
+	}
+	if !query.To.IsZero() {
+		toDay = query.To.Add(-time.Nanosecond).UTC().Format(dayLayout)
+	}
+	unique, dailyUnique, err := CountUniqueVisitors(ctx, query.ShortURL, fromDay, toDay, query.IncludeBots)
+	if err != nil {
+		return nil, err
+	}
+	stats.UniqueVisitors = unique
+
+	days := make([]string, 0, len(counts.daily))
+	for day := range counts.daily {
+		days = append(days, day)
+	}
+	for day := range dailyUnique {
+		if _, ok := counts.daily[day]; !ok {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	for _, day := range days {
+		stats.Daily = append(stats.Daily, DailyStats{
+			Date:           day,
+			Clicks:         counts.daily[day],
+			UniqueVisitors: dailyUnique[day],
+		})
+	}
+	return stats, nil
+}
+
+// addRawClicks adds the raw clicks of the query's short URL recorded in
+// [from, to) to counts. Zero times leave that end open.
+func addRawClicks(ctx context.Context, counts *clickCounts, query StatsQuery, from, to time.Time) error {
+	match := bson.M{"short_url": query.ShortURL}
+	if !query.IncludeBots {
+		match["is_bot"] = false
+	}
+	timeRange := bson.M{}
+	if !from.IsZero() {
+		timeRange["$gte"] = from
+	}
+	if !to.IsZero() {
+		timeRange["$lt"] = to
+	}
+	if len(timeRange) > 0 {
+		match["timestamp"] = timeRange
+	}
+
+	groupBy := func(field interface{}) bson.A {
+		return bson.A{
+			bson.M{"$group": bson.M{"_id": field, "count": bson.M{"$sum": 1}}},
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$facet", Value: bson.M{
+			"totals": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":   nil,
+					"total": bson.M{"$sum": 1},
+					"bots":  bson.M{"$sum": bson.M{"$cond": bson.A{"$is_bot", 1, 0}}},
+				}},
+			},
+			"browsers": groupBy("$browser"),
+			"os":       groupBy("$os"),
+			"devices":  groupBy("$device"),
+			"daily": groupBy(bson.M{"$dateToString": bson.M{
+				"format": "%Y-%m-%d", "date": "$timestamp", "timezone": "UTC",
+			}}),
+		}}},
+	}
+
+	cursor, err := clickCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	type bucket struct {
+		ID    string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	var results []struct {
+		Totals []struct {
+			Total int64 `bson:"total"`
+			Bots  int64 `bson:"bots"`
+		} `bson:"totals"`
+		Browsers []bucket `bson:"browsers"`
+		OS       []bucket `bson:"os"`
+		Devices  []bucket `bson:"devices"`
+		Daily    []bucket `bson:"daily"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	addBuckets := func(m map[string]int64, buckets []bucket) {
+		for _, b := range buckets {
+			m[b.ID] += b.Count
+		}
+	}
+
+	if len(results[0].Totals) > 0 {
+		counts.total += results[0].Totals[0].Total
+		counts.bots += results[0].Totals[0].Bots
+	}
+	addBuckets(counts.browsers, results[0].Browsers)
+	addBuckets(counts.os, results[0].OS)
+	addBuckets(counts.devices, results[0].Devices)
+	addBuckets(counts.daily, results[0].Daily)
+	return nil
+}
+
+// StreamClicks calls fn for every raw click matching the query, oldest
+// first, stopping at the first error. Exports can run for a long time, so
+// there is no deadline: ctx is expected to end when the client goes away.
+func StreamClicks(ctx context.Context, query StatsQuery, fn func(Click) error) (err error) {
+	ctx, span := tracing.Start(ctx, "models.StreamClicks", attribute.String("short_url", query.ShortURL))
+	defer tracing.End(span, &err)
+
+	filter := bson.M{"short_url": query.ShortURL}
+	if !query.IncludeBots {
+		filter["is_bot"] = false
+	}
+	timeRange := bson.M{}
+	if !query.From.IsZero() {
+		timeRange["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		timeRange["$lt"] = query.To
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := clickCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var click Click
+		if err := cursor.Decode(&click); err != nil {
+			return err
+		}
+		if err := fn(click); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
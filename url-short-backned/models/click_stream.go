@@ -0,0 +1,84 @@
+package models
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Events buffered per live subscriber before new ones are dropped
+const subscriberBufferSize = 64
+
+// ClickSubscription receives clicks as they are tracked
+type ClickSubscription struct {
+	// C delivers the clicks of the subscribed short URL, or of every short
+	// URL for a subscription to all clicks. It is closed at shutdown.
+	C <-chan Click
+
+	shortURL string
+	events   chan Click
+	dropped  atomic.Int64
+	once     sync.Once
+}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   = make(map[*ClickSubscription]struct{})
+)
+
+// SubscribeClicks subscribes to clicks on shortURL, or on every short URL
+// when shortURL is empty. The subscription must be closed when done.
+func SubscribeClicks(shortURL string) *ClickSubscription {
+	events := make(chan Click, subscriberBufferSize)
+	sub := &ClickSubscription{C: events, shortURL: shortURL, events: events}
+
+	subscribersMu.Lock()
+	subscribers[sub] = struct{}{}
+	subscribersMu.Unlock()
+	return sub
+}
+
+// Close ends the subscription
+func (s *ClickSubscription) Close() {
+	s.once.Do(func() {
+		subscribersMu.Lock()
+		delete(subscribers, s)
+		subscribersMu.Unlock()
+	})
+}
+
+// CloseClickSubscriptions ends every live subscription by closing its
+// channel, so streaming handlers return during shutdown
+func CloseClickSubscriptions() {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	for sub := range subscribers {
+		close(sub.events)
+		delete(subscribers, sub)
+	}
+}
+
+// Dropped returns and resets the number of clicks dropped because the
+// subscriber fell behind
+func (s *ClickSubscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+// publishClick delivers a click to every matching subscriber. Subscribers
+// whose buffer is full miss the click rather than slowing down the
+// redirect that produced it.
+func publishClick(click Click) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+
+	for sub := range subscribers {
+		if sub.shortURL != "" && sub.shortURL != click.ShortURL {
+			continue
+		}
+		select {
+		case sub.events <- click:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
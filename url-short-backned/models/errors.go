@@ -0,0 +1,32 @@
+package models
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrNotFound is returned when a short URL does not exist
+	ErrNotFound = errors.New("short URL not found")
+
+	// ErrInvalidPassword is returned when a protected URL's password is wrong
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+// DisabledError is returned for a link that was disabled, along with its
+// original URL
+type DisabledError struct {
+	// Reason is why the link was disabled, such as DisabledThreatFeed
+	Reason string
+}
+
+func (e *DisabledError) Error() string {
+	return "short URL disabled: " + e.Reason
+}
+
+// IsUnavailable reports whether err means MongoDB could not be reached, as
+// opposed to the operation itself failing
+func IsUnavailable(err error) bool {
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err)
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureIndexes creates the indexes the models rely on
+func EnsureIndexes(ctx context.Context) error {
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		urlCollection: {
+			// Sparse, since password-protected links share the collection
+			// under a different field name
+			{Keys: bson.D{{Key: "short_url", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+			// Lets the key pool check codes against password-protected links
+			{Keys: bson.D{{Key: "shortURL", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		clickCollection: {
+			{Keys: bson.D{{Key: "short_url", Value: 1}, {Key: "timestamp", Value: 1}}},
+			{Keys: bson.D{{Key: "visitor", Value: 1}}, Options: options.Index().SetSparse(true)},
+			{Keys: bson.D{{Key: "ip", Value: 1}}, Options: options.Index().SetSparse(true)},
+		},
+		rollupCollection: {
+			{
+				Keys: bson.D{
+					{Key: "short_url", Value: 1}, {Key: "granularity", Value: 1},
+					{Key: "bucket", Value: 1}, {Key: "bots", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		reportCollection: {
+			{Keys: bson.D{{Key: "short_url", Value: 1}, {Key: "reporter", Value: 1}}},
+			{Keys: bson.D{{Key: "resolved_at", Value: 1}, {Key: "short_url", Value: 1}}},
+			{Keys: bson.D{{Key: "reporter", Value: 1}}},
+		},
+		visitorCollection: {
+			{
+				Keys:    bson.D{{Key: "short_url", Value: 1}, {Key: "day", Value: 1}, {Key: "bots", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+			return fmt.Errorf("failed to create indexes on %s: %v", collection.Name(), err)
+		}
+	}
+
+	return ensureClickTTL(ctx)
+}
+
+// ensureClickTTL makes the TTL index on raw clicks match the configured
+// raw click TTL, creating, updating or dropping it as needed
+func ensureClickTTL(ctx context.Context) error {
+	const indexName = "timestamp_ttl"
+	ttlSeconds := int32(settings.RawClickTTL / time.Second)
+
+	cursor, err := clickCollection.Indexes().List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list click indexes: %v", err)
+	}
+	var existing []struct {
+		Name               string `bson:"name"`
+		ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+	}
+	if err := cursor.All(ctx, &existing); err != nil {
+		return fmt.Errorf("failed to list click indexes: %v", err)
+	}
+
+	for _, index := range existing {
+		if index.Name != indexName {
+			continue
+		}
+		switch {
+		case ttlSeconds == 0:
+			_, err = clickCollection.Indexes().DropOne(ctx, indexName)
+		case index.ExpireAfterSeconds == nil || *index.ExpireAfterSeconds != ttlSeconds:
+			err = clickCollection.Database().RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: clickCollection.Name()},
+				{Key: "index", Value: bson.M{"name": indexName, "expireAfterSeconds": ttlSeconds}},
+			}).Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update click TTL index: %v", err)
+		}
+		return nil
+	}
+
+	if ttlSeconds == 0 {
+		return nil
+	}
+	_, err = clickCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetName(indexName).SetExpireAfterSeconds(ttlSeconds),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create click TTL index: %v", err)
+	}
+	return nil
+}
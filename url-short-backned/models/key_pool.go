@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+	"url-short-backned/metrics"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var keyCollection *mongo.Collection
+
+const (
+	// Wait before retrying a failed key allocation
+	keyAllocationRetryDelay = 5 * time.Second
+
+	// How often the pool is topped up when nothing asks for it
+	keyPoolCheckInterval = 10 * time.Second
+)
+
+// allocatedKey records a short code handed to an instance's pool. The
+// code is its _id, so no code is ever handed out twice.
+type allocatedKey struct {
+	Code        string    `bson:"_id"`
+	InstanceID  string    `bson:"instance_id"`
+	AllocatedAt time.Time `bson:"allocated_at"`
+}
+
+var (
+	keyPool       chan string
+	keyPoolRefill = make(chan struct{}, 1)
+
+	keysAllocated = metrics.NewCounterVec("urlshortener_keys_allocated_total",
+		"Short codes allocated into this instance's key pool.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("urlshortener_key_pool_available",
+		"Short codes ready in this instance's key pool.",
+		func() float64 { return float64(len(keyPool)) })
+}
+
+// StartKeyPool starts the background goroutine that keeps the pool of
+// pre-allocated short codes topped up. It refills the pool in batches
+// whenever it falls below half full.
+func StartKeyPool() {
+	startWorker("key_pool", func(stop <-chan struct{}) {
+		for {
+			wait := keyPoolCheckInterval
+			for len(keyPool) <= cap(keyPool)/2 {
+				ctx, cancel := withQueryTimeout(context.Background())
+				keys, err := allocateKeys(ctx, min(settings.KeyBatchSize, cap(keyPool)-len(keyPool)))
+				cancel()
+				if err != nil {
+					slog.Warn("Error allocating short codes", "retry_in", keyAllocationRetryDelay, "error", err)
+					wait = keyAllocationRetryDelay
+					break
+				}
+				for _, key := range keys {
+					keyPool <- key
+				}
+			}
+
+			select {
+			case <-keyPoolRefill:
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// NextKey returns an unused short code from the pool, waiting for a
+// refill when the pool has run dry
+func NextKey(ctx context.Context) (string, error) {
+	select {
+	case key := <-keyPool:
+		if len(keyPool) <= cap(keyPool)/2 {
+			refillKeyPool()
+		}
+		return key, nil
+	default:
+	}
+
+	refillKeyPool()
+	select {
+	case key := <-keyPool:
+		return key, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// refillKeyPool wakes the key pool worker without waiting for it
+func refillKeyPool() {
+	select {
+	case keyPoolRefill <- struct{}{}:
+	default:
+	}
+}
+
+// allocateKeys generates up to n random codes and claims them in the keys
+// collection. Codes that links created before the pool already use, or
+// that another instance claimed first, are left out.
+func allocateKeys(ctx context.Context, n int) ([]string, error) {
+	candidates := make(map[string]bool, n)
+	for len(candidates) < n {
+		candidates[utils.GenerateShortURL()] = true
+	}
+	codes := make([]string, 0, n)
+	for code := range candidates {
+		codes = append(codes, code)
+	}
+
+	existing, err := usedCodes(ctx, codes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	docs := make([]interface{}, 0, len(codes))
+	unused := codes[:0]
+	for _, code := range codes {
+		if existing[code] {
+			continue
+		}
+		docs = append(docs, allocatedKey{Code: code, InstanceID: settings.InstanceID, AllocatedAt: now})
+		unused = append(unused, code)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	_, err = keyCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	claimed := make([]bool, len(unused))
+	for i := range claimed {
+		claimed[i] = true
+	}
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			return nil, err
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(writeErr) {
+				return nil, err
+			}
+			claimed[writeErr.Index] = false
+		}
+	}
+
+	keys := make([]string, 0, len(unused))
+	for i, code := range unused {
+		if claimed[i] {
+			keys = append(keys, code)
+		}
+	}
+	keysAllocated.Add(float64(len(keys)))
+	return keys, nil
+}
+
+// usedCodes returns those codes that links created before the pool
+// already use, including password-protected links, which store their code
+// under a different field name
+func usedCodes(ctx context.Context, codes []string) (map[string]bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"short_url": bson.M{"$in": codes}},
+		bson.M{"shortURL": bson.M{"$in": codes}},
+	}}
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "short_url": 1, "shortURL": 1})
+	cursor, err := urlCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var urls []struct {
+		ShortURL          string `bson:"short_url"`
+		ProtectedShortURL string `bson:"shortURL"`
+	}
+	if err := cursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		used[url.ShortURL] = true
+		used[url.ProtectedShortURL] = true
+	}
+	return used, nil
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"url-short-backned/cache"
+	"url-short-backned/config"
+)
+
+// settings is the configuration the models were initialised with
+var settings *config.Config
+
+// Init binds the models to the connected MongoDB client and to cfg. It must
+// be called after config.InitMongoClient and before any other function in
+// this package.
+func Init(cfg *config.Config) {
+	settings = cfg
+
+	db := config.Client.Database(cfg.Database)
+	urlCollection = db.Collection("urls")
+	clickCollection = db.Collection("clicks")
+	visitorCollection = db.Collection("visitor_sketches")
+	rollupCollection = db.Collection("click_rollups")
+	rollupStateCollection = db.Collection("rollup_state")
+	changeStreamStateCollection = db.Collection("change_stream_state")
+	keyCollection = db.Collection("keys")
+	reportCollection = db.Collection("reports")
+	bannedHostCollection = db.Collection("banned_hosts")
+	ownerPrivacyCollection = db.Collection("owner_privacy")
+
+	urlCache = cache.New[string, urlEntry](cfg.URLCacheSize)
+	linkPrivacyCache = cache.New[string, Privacy](cfg.URLCacheSize)
+	keyPool = make(chan string, cfg.KeyPoolSize)
+}
+
+// withQueryTimeout bounds a single lookup or write by the query timeout
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, settings.QueryTimeout)
+}
+
+// withAnalyticsTimeout bounds a stats query or rollup pass by the
+// analytics timeout
+func withAnalyticsTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, settings.AnalyticsTimeout)
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"context"
+	"time"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OwnerData is everything stored about the links of one owner but their
+// raw clicks, which are too many to hold at once and are read with
+// StreamClicks
+type OwnerData struct {
+	Privacy        Privacy        `json:"privacy"`
+	Links          []OwnedLink    `json:"links"`
+	Reports        []LinkReport   `json:"reports"`
+	Rollups        []LinkRollup   `json:"rollups"`
+	UniqueVisitors []LinkVisitors `json:"uniqueVisitors"`
+}
+
+// OwnedLink is a link as exported to its owner
+type OwnedLink struct {
+	ShortURL          string    `json:"shortUrl"`
+	OriginalURL       string    `json:"originalUrl"`
+	PasswordProtected bool      `json:"passwordProtected"`
+	CreatedAt         time.Time `json:"createdAt"`
+	DisabledReason    string    `json:"disabledReason,omitempty"`
+}
+
+// LinkReport is an abuse report of a link. Who filed it is left out.
+type LinkReport struct {
+	ShortURL   string    `json:"shortUrl" bson:"short_url"`
+	Reason     string    `json:"reason" bson:"reason"`
+	Details    string    `json:"details,omitempty" bson:"details,omitempty"`
+	ReportedAt time.Time `json:"reportedAt" bson:"reported_at"`
+	Resolution string    `json:"resolution,omitempty" bson:"resolution,omitempty"`
+	ResolvedAt time.Time `json:"resolvedAt,omitempty" bson:"resolved_at,omitempty"`
+}
+
+// LinkRollup is an hourly or daily click rollup of a link
+type LinkRollup struct {
+	ShortURL    string           `json:"shortUrl"`
+	Granularity string           `json:"granularity"`
+	Bucket      time.Time        `json:"bucket"`
+	Bots        bool             `json:"bots"`
+	Clicks      int64            `json:"clicks"`
+	Browsers    map[string]int64 `json:"browsers"`
+	OS          map[string]int64 `json:"os"`
+	Devices     map[string]int64 `json:"devices"`
+}
+
+// LinkVisitors is the unique visitor estimate of a link for one UTC day,
+// as its stored sketch gives it
+type LinkVisitors struct {
+	ShortURL       string `json:"shortUrl"`
+	Day            string `json:"day"`
+	Bots           bool   `json:"bots"`
+	UniqueVisitors uint64 `json:"uniqueVisitors"`
+}
+
+// ErasedOwnerData counts what EraseOwnerData deleted
+type ErasedOwnerData struct {
+	Links           int64 `json:"links"`
+	Clicks          int64 `json:"clicks"`
+	Rollups         int64 `json:"rollups"`
+	VisitorSketches int64 `json:"visitorSketches"`
+	Reports         int64 `json:"reports"`
+}
+
+// GetOwnerData returns the privacy settings owner chose and the links
+// they created, password-protected or not, with the abuse reports, rollups
+// and unique visitor counts stored about them
+func GetOwnerData(ctx context.Context, owner string) (*OwnerData, error) {
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	links, err := ownedLinks(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	var privacy ownerPrivacy
+	err = ownerPrivacyCollection.FindOne(ctx, bson.M{"_id": owner}).Decode(&privacy)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	data := &OwnerData{
+		Privacy:        privacy.Privacy,
+		Links:          make([]OwnedLink, len(links)),
+		Reports:        []LinkReport{},
+		Rollups:        []LinkRollup{},
+		UniqueVisitors: []LinkVisitors{},
+	}
+	for i, link := range links {
+		data.Links[i] = OwnedLink{
+			ShortURL:          link.code(),
+			OriginalURL:       link.destination(),
+			PasswordProtected: link.protected(),
+			CreatedAt:         link.CreatedAt,
+			DisabledReason:    link.DisabledReason,
+		}
+	}
+	if len(links) == 0 {
+		return data, nil
+	}
+	owned := bson.M{"short_url": bson.M{"$in": shortURLsOf(links)}}
+
+	opts := options.Find().SetSort(bson.D{{Key: "reported_at", Value: 1}})
+	cursor, err := reportCollection.Find(ctx, owned, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &data.Reports); err != nil {
+		return nil, err
+	}
+
+	opts = options.Find().SetSort(bson.D{{Key: "short_url", Value: 1}, {Key: "bucket", Value: 1}})
+	cursor, err = rollupCollection.Find(ctx, owned, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rollups []clickRollup
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	for _, rollup := range rollups {
+		data.Rollups = append(data.Rollups, LinkRollup(rollup))
+	}
+
+	opts = options.Find().SetSort(bson.D{{Key: "short_url", Value: 1}, {Key: "day", Value: 1}})
+	cursor, err = visitorCollection.Find(ctx, owned, opts)
+	if err != nil {
+		return nil, err
+	}
+	var sketches []visitorSketch
+	if err := cursor.All(ctx, &sketches); err != nil {
+		return nil, err
+	}
+	for _, stored := range sketches {
+		sketch, err := utils.HyperLogLogFromBytes(stored.Registers)
+		if err != nil {
+			return nil, err
+		}
+		data.UniqueVisitors = append(data.UniqueVisitors, LinkVisitors{
+			ShortURL:       stored.ShortURL,
+			Day:            stored.Day,
+			Bots:           stored.Bots,
+			UniqueVisitors: sketch.Count(),
+		})
+	}
+	return data, nil
+}
+
+// EraseOwnerData deletes the privacy settings owner chose and the links
+// they created, password-protected or not, with their raw clicks, rollups,
+// visitor sketches and abuse reports. Hosts banned because of one of the
+// links stay banned.
+func EraseOwnerData(ctx context.Context, owner string) (ErasedOwnerData, error) {
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	var erased ErasedOwnerData
+	if _, err := ownerPrivacyCollection.DeleteOne(ctx, bson.M{"_id": owner}); err != nil {
+		return erased, err
+	}
+	links, err := ownedLinks(ctx, owner)
+	if err != nil || len(links) == 0 {
+		return erased, err
+	}
+	shortURLs := shortURLsOf(links)
+
+	// The links go first, so no new clicks are recorded on them
+	result, err := urlCollection.DeleteMany(ctx, bson.M{"owner": owner})
+	if err != nil {
+		return erased, err
+	}
+	erased.Links = result.DeletedCount
+	for _, shortURL := range shortURLs {
+		InvalidateURL(ctx, shortURL)
+	}
+
+	owned := bson.M{"short_url": bson.M{"$in": shortURLs}}
+	if result, err = clickCollection.DeleteMany(ctx, owned); err != nil {
+		return erased, err
+	}
+	erased.Clicks = result.DeletedCount
+	if result, err = rollupCollection.DeleteMany(ctx, owned); err != nil {
+		return erased, err
+	}
+	erased.Rollups = result.DeletedCount
+	if result, err = visitorCollection.DeleteMany(ctx, owned); err != nil {
+		return erased, err
+	}
+	erased.VisitorSketches = result.DeletedCount
+	if result, err = reportCollection.DeleteMany(ctx, owned); err != nil {
+		return erased, err
+	}
+	erased.Reports = result.DeletedCount
+	return erased, nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEraseOwnerData(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("erases both kinds of links", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		deleted := func(n int32) bson.D {
+			return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n})
+		}
+		mt.AddMockResponses(
+			deleted(1),
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch,
+				bson.D{{Key: "short_url", Value: "plainLnk"}, {Key: "original_url", Value: "https://example.com/"}},
+				protectedLink,
+			),
+			deleted(2), deleted(5), deleted(3), deleted(2), deleted(1),
+		)
+
+		erased, err := EraseOwnerData(context.Background(), "user:alice")
+		if err != nil {
+			mt.Fatalf("EraseOwnerData: %v", err)
+		}
+		want := ErasedOwnerData{Links: 2, Clicks: 5, Rollups: 3, VisitorSketches: 2, Reports: 1}
+		if erased != want {
+			mt.Errorf("erased %+v; want %+v", erased, want)
+		}
+
+		var privacy struct {
+			Delete  string `bson:"delete"`
+			Deletes []struct {
+				Q bson.M `bson:"q"`
+			} `bson:"deletes"`
+		}
+		if err := bson.Unmarshal(startedCommand(mt, "delete"), &privacy); err != nil || privacy.Delete != "owner_privacy" || len(privacy.Deletes) != 1 || privacy.Deletes[0].Q["_id"] != "user:alice" {
+			mt.Fatalf("privacy settings deleted with %+v, %v; want the owner's", privacy, err)
+		}
+		startedCommand(mt, "find")
+		var links struct {
+			Deletes []struct {
+				Q bson.M `bson:"q"`
+			} `bson:"deletes"`
+		}
+		if err := bson.Unmarshal(startedCommand(mt, "delete"), &links); err != nil || len(links.Deletes) != 1 || links.Deletes[0].Q["owner"] != "user:alice" {
+			mt.Fatalf("links deleted with %+v, %v; want the owner's", links, err)
+		}
+		for _, collection := range []string{"clicks", "click_rollups", "visitor_sketches", "reports"} {
+			var cmd struct {
+				Delete  string `bson:"delete"`
+				Deletes []struct {
+					Q struct {
+						ShortURL struct {
+							In []string `bson:"$in"`
+						} `bson:"short_url"`
+					} `bson:"q"`
+				} `bson:"deletes"`
+			}
+			if err := bson.Unmarshal(startedCommand(mt, "delete"), &cmd); err != nil || len(cmd.Deletes) != 1 {
+				mt.Fatalf("decoding the delete from %s: %v", collection, err)
+			}
+			codes := cmd.Deletes[0].Q.ShortURL.In
+			if cmd.Delete != collection || len(codes) != 2 || codes[0] != "plainLnk" || codes[1] != "aB3dE5gH" {
+				mt.Errorf("deleted %v from %s; want both links from %s", codes, cmd.Delete, collection)
+			}
+		}
+	})
+	mt.Run("no links", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch),
+		)
+
+		if erased, err := EraseOwnerData(context.Background(), "user:bob"); err != nil || erased != (ErasedOwnerData{}) {
+			mt.Errorf("EraseOwnerData = %+v, %v; want nothing erased", erased, err)
+		}
+		startedCommand(mt, "delete")
+		startedCommand(mt, "find")
+		if event := mt.GetStartedEvent(); event != nil {
+			mt.Errorf("EraseOwnerData sent %s without links to erase", event.CommandName)
+		}
+	})
+}
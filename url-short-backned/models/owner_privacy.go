@@ -0,0 +1,253 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"url-short-backned/cache"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ownerPrivacyCollection *mongo.Collection
+
+// How long the click worker trusts the privacy settings it looked up for
+// a link. Changes made on other instances take this long to apply.
+const linkPrivacyTTL = time.Minute
+
+// linkPrivacyCache holds the effective privacy settings of recently
+// clicked links
+var linkPrivacyCache *cache.LRU[string, Privacy]
+
+// Privacy is how the clicks on an owner's links are tracked. Owners can
+// only tighten the deployment's settings, never loosen them.
+type Privacy struct {
+	// AnonymizeIPs truncates client IPs before clicks are stored
+	AnonymizeIPs bool `json:"anonymizeIps" bson:"anonymize_ips"`
+
+	// RespectDoNotTrack skips individual tracking for visitors who send
+	// DNT: 1 or Sec-GPC: 1
+	RespectDoNotTrack bool `json:"respectDnt" bson:"respect_dnt"`
+
+	// RetentionDays is how many days raw clicks, rollups and visitor
+	// sketches are kept. Zero keeps them as long as the deployment does.
+	RetentionDays int `json:"retentionDays" bson:"retention_days"`
+}
+
+// ownerPrivacy is the stored privacy settings of one owner
+type ownerPrivacy struct {
+	Owner     string `bson:"_id"`
+	Privacy   `bson:",inline"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// strictestPrivacy is what clicks are stored with when the settings of
+// their link's owner can't be looked up
+var strictestPrivacy = Privacy{AnonymizeIPs: true, RespectDoNotTrack: true}
+
+// Effective returns the settings clicks are tracked with: the
+// deployment's, tightened by p
+func (p Privacy) Effective() Privacy {
+	effective := Privacy{
+		AnonymizeIPs:      settings.AnonymizeIPs || p.AnonymizeIPs,
+		RespectDoNotTrack: settings.RespectDoNotTrack || p.RespectDoNotTrack,
+		RetentionDays:     p.RetentionDays,
+	}
+	if days := int(settings.AnalyticsRetention / (24 * time.Hour)); days > 0 && (effective.RetentionDays == 0 || days < effective.RetentionDays) {
+		effective.RetentionDays = days
+	}
+	return effective
+}
+
+// GetOwnerPrivacy returns the privacy settings owner chose for their
+// links. They are zero when the owner chose none.
+func GetOwnerPrivacy(ctx context.Context, owner string) (Privacy, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var stored ownerPrivacy
+	err := ownerPrivacyCollection.FindOne(ctx, bson.M{"_id": owner}).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return Privacy{}, nil
+	}
+	return stored.Privacy, err
+}
+
+// SetOwnerPrivacy stores the privacy settings owner chose for their links.
+// They apply to clicks stored from then on, after up to linkPrivacyTTL on
+// other instances.
+func SetOwnerPrivacy(ctx context.Context, owner string, privacy Privacy) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var err error
+	if privacy == (Privacy{}) {
+		_, err = ownerPrivacyCollection.DeleteOne(ctx, bson.M{"_id": owner})
+	} else {
+		_, err = ownerPrivacyCollection.ReplaceOne(ctx, bson.M{"_id": owner},
+			ownerPrivacy{Owner: owner, Privacy: privacy, UpdatedAt: time.Now()},
+			options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		return err
+	}
+	linkPrivacyCache.Purge()
+	return nil
+}
+
+// applyOwnerPrivacy applies the settings of their links' owners to a batch
+// of clicks about to be stored
+func applyOwnerPrivacy(ctx context.Context, clicks []Click) {
+	shortURLs := make([]string, 0, len(clicks))
+	for _, click := range clicks {
+		if click.IP != "" {
+			shortURLs = append(shortURLs, click.ShortURL)
+		}
+	}
+	if len(shortURLs) == 0 {
+		return
+	}
+
+	privacy := linkPrivacy(ctx, shortURLs)
+	for i := range clicks {
+		click := &clicks[i]
+		if click.IP == "" {
+			continue
+		}
+		p := privacy[click.ShortURL]
+		if click.DoNotTrack && p.RespectDoNotTrack {
+			click.IP, click.UserAgent, click.Referrer = "", "", ""
+			click.VisitorHash = 0
+		} else if p.AnonymizeIPs {
+			click.IP = utils.AnonymizeIP(click.IP)
+		}
+	}
+}
+
+// linkPrivacy returns the effective privacy settings of the given links.
+// When they can't be looked up, the strictest settings are returned.
+func linkPrivacy(ctx context.Context, shortURLs []string) map[string]Privacy {
+	privacy := make(map[string]Privacy, len(shortURLs))
+	var missing []string
+	for _, shortURL := range shortURLs {
+		if _, ok := privacy[shortURL]; ok {
+			continue
+		}
+		if p, ok := linkPrivacyCache.Get(shortURL); ok {
+			privacy[shortURL] = p
+			continue
+		}
+		// Placeholder, so duplicates are looked up once
+		privacy[shortURL] = strictestPrivacy
+		missing = append(missing, shortURL)
+	}
+	if len(missing) == 0 {
+		return privacy
+	}
+
+	loaded, err := loadLinkPrivacy(ctx, missing)
+	if err != nil {
+		slog.Warn("Error loading link privacy settings, storing clicks with the strictest", "error", err)
+		return privacy
+	}
+	for _, shortURL := range missing {
+		p := loaded[shortURL].Effective()
+		privacy[shortURL] = p
+		linkPrivacyCache.Add(shortURL, p, linkPrivacyTTL)
+	}
+	return privacy
+}
+
+// loadLinkPrivacy returns the privacy settings the owners of the given
+// links chose, keyed by short URL. Links without owner or settings are
+// left out.
+func loadLinkPrivacy(ctx context.Context, shortURLs []string) (map[string]Privacy, error) {
+	cursor, err := urlCollection.Find(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"short_url": bson.M{"$in": shortURLs}},
+			bson.M{"shortURL": bson.M{"$in": shortURLs}},
+		}},
+		options.Find().SetProjection(bson.M{"short_url": 1, "shortURL": 1, "owner": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var links []storedLink
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+
+	var owners []string
+	for _, link := range links {
+		if link.Owner != "" {
+			owners = append(owners, link.Owner)
+		}
+	}
+	if len(owners) == 0 {
+		return nil, nil
+	}
+
+	cursor, err = ownerPrivacyCollection.Find(ctx, bson.M{"_id": bson.M{"$in": owners}})
+	if err != nil {
+		return nil, err
+	}
+	var stored []ownerPrivacy
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+	byOwner := make(map[string]Privacy, len(stored))
+	for _, owner := range stored {
+		byOwner[owner.Owner] = owner.Privacy
+	}
+
+	privacy := make(map[string]Privacy)
+	for _, link := range links {
+		if p, ok := byOwner[link.Owner]; ok {
+			privacy[link.code()] = p
+		}
+	}
+	return privacy, nil
+}
+
+// deleteExpiredOwnerAnalytics removes the raw clicks, rollups and visitor
+// sketches that outlived the retention their links' owners chose, where it
+// is shorter than the deployment's
+func deleteExpiredOwnerAnalytics(ctx context.Context) error {
+	cursor, err := ownerPrivacyCollection.Find(ctx, bson.M{"retention_days": bson.M{"$gt": 0}})
+	if err != nil {
+		return err
+	}
+	var owners []ownerPrivacy
+	if err := cursor.All(ctx, &owners); err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		retention := time.Duration(owner.RetentionDays) * 24 * time.Hour
+		if settings.AnalyticsRetention > 0 && settings.AnalyticsRetention <= retention {
+			continue // The deployment-wide pass covers it
+		}
+		links, err := ownedLinks(ctx, owner.Owner)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			continue
+		}
+
+		cutoff := time.Now().UTC().Add(-retention).Truncate(24 * time.Hour)
+		owned := bson.M{"$in": shortURLsOf(links)}
+		if _, err := clickCollection.DeleteMany(ctx, bson.M{"short_url": owned, "timestamp": bson.M{"$lt": cutoff}}); err != nil {
+			return err
+		}
+		if _, err := rollupCollection.DeleteMany(ctx, bson.M{"short_url": owned, "bucket": bson.M{"$lt": cutoff}}); err != nil {
+			return err
+		}
+		if _, err := visitorCollection.DeleteMany(ctx, bson.M{"short_url": owned, "day": bson.M{"$lt": cutoff.Format(dayLayout)}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+	"url-short-backned/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestPrivacyEffective(t *testing.T) {
+	previous := settings
+	settings = config.Default()
+	t.Cleanup(func() { settings = previous })
+
+	tests := []struct {
+		name       string
+		deployment Privacy
+		retention  time.Duration
+		owner      Privacy
+		want       Privacy
+	}{
+		{"defaults", Privacy{}, 0, Privacy{}, Privacy{}},
+		{"owner tightens", Privacy{}, 0, Privacy{AnonymizeIPs: true, RespectDoNotTrack: true, RetentionDays: 30}, Privacy{AnonymizeIPs: true, RespectDoNotTrack: true, RetentionDays: 30}},
+		{"owner can't loosen", Privacy{AnonymizeIPs: true, RespectDoNotTrack: true}, 0, Privacy{}, Privacy{AnonymizeIPs: true, RespectDoNotTrack: true}},
+		{"shorter deployment retention", Privacy{}, 7 * 24 * time.Hour, Privacy{RetentionDays: 30}, Privacy{RetentionDays: 7}},
+		{"shorter owner retention", Privacy{}, 90 * 24 * time.Hour, Privacy{RetentionDays: 30}, Privacy{RetentionDays: 30}},
+		{"deployment retention only", Privacy{}, 90 * 24 * time.Hour, Privacy{}, Privacy{RetentionDays: 90}},
+	}
+	for _, tt := range tests {
+		settings.AnonymizeIPs = tt.deployment.AnonymizeIPs
+		settings.RespectDoNotTrack = tt.deployment.RespectDoNotTrack
+		settings.AnalyticsRetention = tt.retention
+		if got := tt.owner.Effective(); got != tt.want {
+			t.Errorf("%s: Effective() = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// trackedClicks returns clicks on two links, as recordClick queues them
+// while the deployment neither truncates IPs nor honours Do Not Track
+func trackedClicks() []Click {
+	click := func(shortURL string, doNotTrack bool) Click {
+		return Click{
+			ShortURL:    shortURL,
+			IP:          "192.0.2.57",
+			UserAgent:   "Mozilla/5.0",
+			Referrer:    "https://example.com/",
+			VisitorHash: 42,
+			DoNotTrack:  doNotTrack,
+		}
+	}
+	return []Click{click("aliceLnk", false), click("aliceLnk", true), click("bobsLink", true)}
+}
+
+func TestApplyOwnerPrivacy(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("applies the owner's settings", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		settings.AnonymizeIPs, settings.RespectDoNotTrack = false, false
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch,
+				bson.D{{Key: "short_url", Value: "aliceLnk"}, {Key: "owner", Value: "user:alice"}},
+				bson.D{{Key: "short_url", Value: "bobsLink"}, {Key: "owner", Value: "user:bob"}},
+			),
+			mtest.CreateCursorResponse(0, "db.owner_privacy", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: "user:alice"}, {Key: "anonymize_ips", Value: true}, {Key: "respect_dnt", Value: true}},
+			),
+		)
+
+		clicks := trackedClicks()
+		applyOwnerPrivacy(context.Background(), clicks)
+
+		if got := clicks[0]; got.IP != "192.0.2.0" || got.UserAgent == "" || got.VisitorHash == 0 {
+			mt.Errorf("tracked click on a truncating owner's link = %+v; want a truncated IP", got)
+		}
+		if got := clicks[1]; got.IP != "" || got.UserAgent != "" || got.Referrer != "" || got.VisitorHash != 0 {
+			mt.Errorf("opted out click on a DNT owner's link = %+v; want nothing tracked", got)
+		}
+		if got := clicks[2]; got != trackedClicks()[2] {
+			mt.Errorf("click on a link without settings = %+v; want it unchanged", got)
+		}
+
+		// The settings are cached
+		startedCommand(mt, "find")
+		startedCommand(mt, "find")
+		applyOwnerPrivacy(context.Background(), trackedClicks())
+		if event := mt.GetStartedEvent(); event != nil {
+			mt.Errorf("applyOwnerPrivacy sent %s for cached links", event.CommandName)
+		}
+	})
+	mt.Run("fails closed", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		settings.AnonymizeIPs, settings.RespectDoNotTrack = false, false
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Message: "bad value"}))
+
+		clicks := trackedClicks()
+		applyOwnerPrivacy(context.Background(), clicks)
+
+		if clicks[0].IP != "192.0.2.0" || clicks[1].IP != "" || clicks[2].IP != "" {
+			mt.Errorf("clicks stored without settings = %+v; want the strictest settings applied", clicks)
+		}
+	})
+}
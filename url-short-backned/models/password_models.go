@@ -2,47 +2,53 @@ package models
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"url-short-backned/config"
+	"time"
+	"url-short-backned/tracing"
 	"golang.org/x/crypto/bcrypt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var URLCollection *mongo.Collection = config.Client.Database("urlshortener").Collection("password_protected_urls")
-
 type PasswordProtectedURL struct {
 	ShortURL    string `bson:"shortURL"`
 	OriginalURL string `bson:"originalURL"`
 	Password    string `bson:"password"`
+
+	// CreatedAt and Owner are recorded as for URL
+	CreatedAt time.Time `bson:"created_at"`
+	Owner     string    `bson:"owner,omitempty"`
+
+	// DisabledReason is set while the link is disabled, as for URL
+	DisabledReason string `bson:"disabled_reason,omitempty"`
 }
 
-// StorePasswordProtectedURL saves a password-protected URL to the MongoDB database
-func StorePasswordProtectedURL(shortURL, originalURL, password string) error {
+// StorePasswordProtectedURL saves a password-protected URL to the MongoDB
+// database. owner is who created it, as for SaveURL.
+func StorePasswordProtectedURL(ctx context.Context, shortURL, originalURL, password, owner string) (err error) {
+	ctx, span := tracing.Start(ctx, "models.StorePasswordProtectedURL", attribute.String("short_url", shortURL))
+	defer tracing.End(span, &err)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	// Hash the password before storing
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	// Check if the short URL already exists in the database
-	var existingURL PasswordProtectedURL
-	err = urlCollection.FindOne(context.Background(), bson.M{"shortURL": shortURL}).Decode(&existingURL)
-	if err != mongo.ErrNoDocuments {
-		// If error is not "no documents", return an error indicating the URL already exists
-		return errors.New("short URL already exists")
-	}
-
 	// Create a new URL object to insert
 	url := PasswordProtectedURL{
 		ShortURL:    shortURL,
 		OriginalURL: originalURL,
 		Password:    string(hashedPassword),
+		CreatedAt:   time.Now(),
+		Owner:       owner,
 	}
 
 	// Insert the new URL into MongoDB
-	_, err = urlCollection.InsertOne(context.Background(), url)
+	_, err = urlCollection.InsertOne(ctx, url)
 	if err != nil {
 		return fmt.Errorf("failed to insert URL: %v", err)
 	}
@@ -50,23 +56,36 @@ func StorePasswordProtectedURL(shortURL, originalURL, password string) error {
 	return nil
 }
 
-// RetrieveURLByPassword retrieves the original URL if the provided password is correct
-func RetrieveURLByPassword(shortURL, password string) (string, bool) {
+// RetrieveURLByPassword retrieves the original URL if the provided password
+// is correct. It returns ErrNotFound or ErrInvalidPassword otherwise. For a
+// disabled link it returns the original URL with a *DisabledError.
+func RetrieveURLByPassword(ctx context.Context, shortURL, password string) (string, error) {
+	ctx, span := tracing.Start(ctx, "models.RetrieveURLByPassword", attribute.String("short_url", shortURL))
+	defer span.End()
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	// Find the URL by short URL
 	var urlData PasswordProtectedURL
-	err := urlCollection.FindOne(context.Background(), bson.M{"shortURL": shortURL}).Decode(&urlData)
+	err := urlCollection.FindOne(ctx, bson.M{"shortURL": shortURL}).Decode(&urlData)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrNotFound
+	}
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return "", false // URL not found
-		}
-		return "", false // Other errors
+		span.RecordError(err)
+		return "", err
 	}
 
 	// Compare the provided password with the hashed password
 	if err := bcrypt.CompareHashAndPassword([]byte(urlData.Password), []byte(password)); err != nil {
-		return "", false // Password is incorrect
+		return "", ErrInvalidPassword
+	}
+
+	// Only say the link is disabled to those who may see where it led
+	if urlData.DisabledReason != "" {
+		return urlData.OriginalURL, &DisabledError{Reason: urlData.DisabledReason}
 	}
 
 	// If the password is correct, return the original URL
-	return urlData.OriginalURL, true
+	return urlData.OriginalURL, nil
 }
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Visitor identifies the subject of a data request by the IP address they
+// visited from and, optionally, their user agent. Clicks stored with a
+// truncated IP can only be told apart from other visitors' clicks with the
+// user agent.
+type Visitor struct {
+	IP        string
+	UserAgent string
+}
+
+// VisitorData is everything stored about one visitor
+type VisitorData struct {
+	Clicks  []Click
+	Reports []VisitorReport
+}
+
+// VisitorReport is an abuse report filed by a visitor
+type VisitorReport struct {
+	ShortURL   string    `json:"shortUrl" bson:"short_url"`
+	Reason     string    `json:"reason" bson:"reason"`
+	Details    string    `json:"details,omitempty" bson:"details,omitempty"`
+	ReportedAt time.Time `json:"reportedAt" bson:"reported_at"`
+}
+
+// ErasedVisitorData counts what EraseVisitorData deleted
+type ErasedVisitorData struct {
+	Clicks  int64 `json:"clicks"`
+	Reports int64 `json:"reports"`
+}
+
+// visitorID formats a visitor hash as stored with clicks and reports
+func visitorID(hash uint64) string {
+	return strconv.FormatUint(hash, 16)
+}
+
+// ReporterID identifies the visitor behind an abuse report. It hashes the
+// truncated IP, so reports from one network count once towards the disable
+// threshold.
+func ReporterID(ip string) string {
+	return visitorID(utils.VisitorHash(settings.VisitorHashSalt, utils.AnonymizeIP(ip), ""))
+}
+
+// clickFilter matches the visitor's clicks. With a user agent, it matches
+// their visitor hash, and for clicks stored before hashes were, their IP
+// in full or truncated form together with the user agent.
+func (v Visitor) clickFilter() bson.M {
+	if v.UserAgent == "" {
+		return bson.M{"ip": v.IP}
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{"visitor": visitorID(utils.VisitorHash(settings.VisitorHashSalt, v.IP, v.UserAgent))},
+		bson.M{
+			"ip":         bson.M{"$in": bson.A{v.IP, utils.AnonymizeIP(v.IP)}},
+			"user_agent": v.UserAgent,
+		},
+	}}
+}
+
+// GetVisitorData returns the clicks and abuse reports stored about a
+// visitor. Rollups and unique visitor sketches hold no per-visitor data,
+// and live click streams keep nothing, so they are not included.
+func GetVisitorData(ctx context.Context, visitor Visitor) (*VisitorData, error) {
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	data := &VisitorData{Clicks: []Click{}, Reports: []VisitorReport{}}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+	cursor, err := clickCollection.Find(ctx, visitor.clickFilter(), opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &data.Clicks); err != nil {
+		return nil, err
+	}
+
+	opts = options.Find().SetSort(bson.D{{Key: "reported_at", Value: 1}})
+	cursor, err = reportCollection.Find(ctx, bson.M{"reporter": ReporterID(visitor.IP)}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &data.Reports); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// EraseVisitorData deletes the clicks and abuse reports stored about a
+// visitor. Their clicks stay counted in rollups and unique visitor
+// sketches, which can't be traced back to them.
+func EraseVisitorData(ctx context.Context, visitor Visitor) (ErasedVisitorData, error) {
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	var erased ErasedVisitorData
+	result, err := clickCollection.DeleteMany(ctx, visitor.clickFilter())
+	if err != nil {
+		return erased, err
+	}
+	erased.Clicks = result.DeletedCount
+
+	result, err = reportCollection.DeleteMany(ctx, bson.M{"reporter": ReporterID(visitor.IP)})
+	if err != nil {
+		return erased, err
+	}
+	erased.Reports = result.DeletedCount
+	return erased, nil
+}
@@ -0,0 +1,306 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	reportCollection     *mongo.Collection
+	bannedHostCollection *mongo.Collection
+)
+
+// Reasons visitors may report a link for
+var ReportReasons = []string{"phishing", "malware", "spam", "illegal", "other"}
+
+// Days of clicks summarised for each link in the moderation queue
+const moderationClickDays = 7
+
+// Moderation actions
+const (
+	// ModerationDisable disables a link until it is restored
+	ModerationDisable = "disable"
+
+	// ModerationBan disables a link and bans its destination host, so no
+	// new links to it can be created
+	ModerationBan = "ban"
+
+	// ModerationRestore enables a link again, lifting the ban on its
+	// destination host if it was banned
+	ModerationRestore = "restore"
+)
+
+// Reasons a link is disabled for by reports and moderators
+const (
+	DisabledReports   = "reports"
+	DisabledModerator = "moderator"
+	DisabledBanned    = "banned"
+)
+
+// report is one visitor's report of a link. A visitor reporting the same
+// link again replaces their report.
+type report struct {
+	ShortURL   string    `bson:"short_url"`
+	Reporter   string    `bson:"reporter"`
+	Reason     string    `bson:"reason"`
+	Details    string    `bson:"details,omitempty"`
+	ReportedAt time.Time `bson:"reported_at"`
+
+	// Resolution is the moderation action that closed the report
+	Resolution string    `bson:"resolution,omitempty"`
+	ResolvedAt time.Time `bson:"resolved_at,omitempty"`
+}
+
+// bannedHost is a destination host no new links may point to
+type bannedHost struct {
+	Host     string    `bson:"_id"`
+	ShortURL string    `bson:"short_url"`
+	Note     string    `bson:"note,omitempty"`
+	BannedAt time.Time `bson:"banned_at"`
+}
+
+// ReportedURL is a link with open reports, as listed in the moderation
+// queue
+type ReportedURL struct {
+	ShortURL        string         `json:"shortUrl"`
+	OriginalURL     string         `json:"originalUrl"`
+	DisabledReason  string         `json:"disabledReason,omitempty"`
+	Reports         int            `json:"reports"`
+	Reasons         map[string]int `json:"reasons"`
+	Details         []string       `json:"details,omitempty"`
+	FirstReportedAt time.Time      `json:"firstReportedAt"`
+	LastReportedAt  time.Time      `json:"lastReportedAt"`
+	RecentClicks    RecentClicks   `json:"recentClicks"`
+}
+
+// RecentClicks summarises the human clicks on a link over the last days
+type RecentClicks struct {
+	Since          time.Time `json:"since"`
+	Clicks         int64     `json:"clicks"`
+	UniqueVisitors uint64    `json:"uniqueVisitors"`
+}
+
+// ReportURL records a visitor's report of a link. reporter identifies the
+// visitor, so repeated reports count once. Once a link has open reports
+// from the configured number of visitors, it is disabled until a
+// moderator looks at it. It returns ErrNotFound for unknown links.
+func ReportURL(ctx context.Context, shortURL, reporter, reason, details string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err := urlCollection.FindOne(ctx, linkFilter(shortURL),
+		options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = reportCollection.ReplaceOne(ctx,
+		bson.M{"short_url": shortURL, "reporter": reporter, "resolved_at": bson.M{"$exists": false}},
+		report{ShortURL: shortURL, Reporter: reporter, Reason: reason, Details: details, ReportedAt: time.Now()},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	if settings.ReportDisableThreshold == 0 {
+		return nil
+	}
+	open, err := reportCollection.CountDocuments(ctx, openReports(shortURL))
+	if err != nil {
+		return err
+	}
+	if open < int64(settings.ReportDisableThreshold) {
+		return nil
+	}
+	return disableURL(ctx, shortURL, DisabledReports, fmt.Sprintf("%d reports", open))
+}
+
+// ModerationQueue returns up to limit links with open reports, most
+// reported first, with their clicks over the last week
+func ModerationQueue(ctx context.Context, limit int) ([]ReportedURL, error) {
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"resolved_at": bson.M{"$exists": false}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$short_url",
+			"reports": bson.M{"$sum": 1},
+			"reasons": bson.M{"$push": "$reason"},
+			"details": bson.M{"$push": "$details"},
+			"first":   bson.M{"$min": "$reported_at"},
+			"last":    bson.M{"$max": "$reported_at"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "reports", Value: -1}, {Key: "last", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := reportCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		ShortURL string    `bson:"_id"`
+		Reports  int       `bson:"reports"`
+		Reasons  []string  `bson:"reasons"`
+		Details  []string  `bson:"details"`
+		First    time.Time `bson:"first"`
+		Last     time.Time `bson:"last"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, len(groups))
+	for i, group := range groups {
+		codes[i] = group.ShortURL
+	}
+	urlCursor, err := urlCollection.Find(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"short_url": bson.M{"$in": codes}},
+			bson.M{"shortURL": bson.M{"$in": codes}},
+		}},
+		options.Find().SetProjection(storedLinkProjection))
+	if err != nil {
+		return nil, err
+	}
+	var urls []storedLink
+	if err := urlCursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+	links := make(map[string]storedLink, len(urls))
+	for _, url := range urls {
+		links[url.code()] = url
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -moderationClickDays).Truncate(24 * time.Hour)
+	queue := make([]ReportedURL, 0, len(groups))
+	for _, group := range groups {
+		link := links[group.ShortURL]
+		item := ReportedURL{
+			ShortURL:        group.ShortURL,
+			OriginalURL:     link.destination(),
+			DisabledReason:  link.DisabledReason,
+			Reports:         group.Reports,
+			Reasons:         make(map[string]int),
+			FirstReportedAt: group.First,
+			LastReportedAt:  group.Last,
+		}
+		for _, reason := range group.Reasons {
+			item.Reasons[reason]++
+		}
+		for _, details := range group.Details {
+			if details != "" {
+				item.Details = append(item.Details, details)
+			}
+		}
+
+		stats, err := GetClickStats(ctx, StatsQuery{ShortURL: group.ShortURL, From: since})
+		if err != nil {
+			return nil, err
+		}
+		item.RecentClicks = RecentClicks{Since: since, Clicks: stats.TotalClicks, UniqueVisitors: stats.UniqueVisitors}
+		queue = append(queue, item)
+	}
+	return queue, nil
+}
+
+// ModerateURL applies a moderation action to a link, password-protected
+// or not, and closes its open reports. It returns ErrNotFound for unknown
+// links.
+func ModerateURL(ctx context.Context, shortURL, action, note string) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var link storedLink
+	err := urlCollection.FindOne(ctx, linkFilter(shortURL),
+		options.FindOne().SetProjection(storedLinkProjection)).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case ModerationDisable:
+		err = setDisabled(ctx, shortURL, DisabledModerator, note)
+	case ModerationBan:
+		if err = setDisabled(ctx, shortURL, DisabledBanned, note); err == nil {
+			err = banHost(ctx, shortURL, link.destination(), note)
+		}
+	case ModerationRestore:
+		if err = enableURL(ctx, shortURL, link.DisabledReason); err == nil && link.DisabledReason == DisabledBanned {
+			_, err = bannedHostCollection.DeleteOne(ctx, bson.M{"_id": destinationHost(link.destination())})
+		}
+	default:
+		return fmt.Errorf("unknown moderation action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = reportCollection.UpdateMany(ctx, openReports(shortURL),
+		bson.M{"$set": bson.M{"resolution": action, "resolved_at": time.Now()}})
+	return err
+}
+
+// IsBannedHost reports whether a moderator banned links to the host of
+// destination
+func IsBannedHost(ctx context.Context, destination string) (bool, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	count, err := bannedHostCollection.CountDocuments(ctx, bson.M{"_id": destinationHost(destination)})
+	return count > 0, err
+}
+
+// setDisabled disables a link for reason, replacing any earlier reason
+func setDisabled(ctx context.Context, shortURL, reason, detail string) error {
+	_, err := urlCollection.UpdateOne(ctx,
+		linkFilter(shortURL),
+		bson.M{"$set": bson.M{"disabled_reason": reason, "disabled_detail": detail, "disabled_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	linksDisabled.Inc(reason)
+	InvalidateURL(ctx, shortURL)
+	return nil
+}
+
+func banHost(ctx context.Context, shortURL, destination, note string) error {
+	host := destinationHost(destination)
+	if host == "" {
+		return nil
+	}
+	_, err := bannedHostCollection.ReplaceOne(ctx,
+		bson.M{"_id": host},
+		bannedHost{Host: host, ShortURL: shortURL, Note: note, BannedAt: time.Now()},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func openReports(shortURL string) bson.M {
+	return bson.M{"short_url": shortURL, "resolved_at": bson.M{"$exists": false}}
+}
+
+// destinationHost returns the lower-case host name of a destination
+func destinationHost(destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
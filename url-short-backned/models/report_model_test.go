@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"url-short-backned/cache"
+	"url-short-backned/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A password-protected link, as StorePasswordProtectedURL stores it
+var protectedLink = bson.D{
+	{Key: "_id", Value: 1},
+	{Key: "shortURL", Value: "aB3dE5gH"},
+	{Key: "originalURL", Value: "https://evil.example/login"},
+	{Key: "password", Value: "hash"},
+}
+
+// useMockDatabase points the models at the mock deployment of mt, with no
+// caches but the local one
+func useMockDatabase(mt *mtest.T) {
+	settings = config.Default()
+	settings.ReportDisableThreshold = 1
+	urlCache = cache.New[string, urlEntry](settings.URLCacheSize)
+	urlCollection = mt.DB.Collection("urls")
+	reportCollection = mt.DB.Collection("reports")
+	bannedHostCollection = mt.DB.Collection("banned_hosts")
+	clickCollection = mt.DB.Collection("clicks")
+	rollupCollection = mt.DB.Collection("click_rollups")
+	visitorCollection = mt.DB.Collection("visitor_sketches")
+	ownerPrivacyCollection = mt.DB.Collection("owner_privacy")
+	linkPrivacyCache = cache.New[string, Privacy](settings.URLCacheSize)
+}
+
+// startedCommand returns the next command sent to the mock deployment
+func startedCommand(mt *mtest.T, name string) bson.Raw {
+	mt.Helper()
+	event := mt.GetStartedEvent()
+	if event == nil || event.CommandName != name {
+		mt.Fatalf("next command is %v; want %s", event, name)
+	}
+	return event.Command
+}
+
+// matchesProtected reports whether the filter of a command would match a
+// link by the field name password-protected links use
+func matchesProtected(command bson.Raw, key string) bool {
+	var cmd struct {
+		Filter  bson.M   `bson:"filter"`
+		Updates []bson.M `bson:"updates"`
+	}
+	if err := bson.Unmarshal(command, &cmd); err != nil {
+		return false
+	}
+	filter := cmd.Filter
+	if filter == nil && len(cmd.Updates) > 0 {
+		filter, _ = cmd.Updates[0]["q"].(bson.M)
+	}
+	alternatives, _ := filter["$or"].(bson.A)
+	for _, alternative := range alternatives {
+		if m, ok := alternative.(bson.M); ok && m["shortURL"] == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReportProtectedURL(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("disables at the threshold", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch, protectedLink),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateCursorResponse(0, "db.reports", mtest.FirstBatch, bson.D{{Key: "n", Value: 1}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		err := ReportURL(context.Background(), "aB3dE5gH", "visitor", "phishing", "")
+		if err != nil {
+			mt.Fatalf("ReportURL: %v", err)
+		}
+
+		if !matchesProtected(startedCommand(mt, "find"), "aB3dE5gH") {
+			mt.Error("ReportURL doesn't look up protected links")
+		}
+		startedCommand(mt, "update")
+		startedCommand(mt, "aggregate")
+		update := startedCommand(mt, "update")
+		if !matchesProtected(update, "aB3dE5gH") {
+			mt.Error("the report threshold doesn't disable protected links")
+		}
+	})
+}
+
+func TestBanProtectedURL(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("bans the destination host", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch, protectedLink),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := ModerateURL(context.Background(), "aB3dE5gH", ModerationBan, "phishing kit"); err != nil {
+			mt.Fatalf("ModerateURL: %v", err)
+		}
+
+		if !matchesProtected(startedCommand(mt, "find"), "aB3dE5gH") {
+			mt.Error("ModerateURL doesn't look up protected links")
+		}
+		if !matchesProtected(startedCommand(mt, "update"), "aB3dE5gH") {
+			mt.Error("ModerateURL doesn't disable protected links")
+		}
+
+		var ban struct {
+			Updates []struct {
+				Q bson.M     `bson:"q"`
+				U bannedHost `bson:"u"`
+			} `bson:"updates"`
+		}
+		if err := bson.Unmarshal(startedCommand(mt, "update"), &ban); err != nil || len(ban.Updates) != 1 {
+			mt.Fatalf("decoding the ban: %v", err)
+		}
+		if host := ban.Updates[0].U; host.Host != "evil.example" || host.ShortURL != "aB3dE5gH" {
+			mt.Errorf("banned %+v; want evil.example for aB3dE5gH", host)
+		}
+		startedCommand(mt, "update")
+	})
+}
+
+func TestRetrieveDisabledProtectedURL(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := bson.D{
+		{Key: "shortURL", Value: "aB3dE5gH"},
+		{Key: "originalURL", Value: "https://evil.example/login"},
+		{Key: "password", Value: string(hash)},
+		{Key: "disabled_reason", Value: DisabledBanned},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("right password", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch, link))
+
+		originalURL, err := RetrieveURLByPassword(context.Background(), "aB3dE5gH", "secret")
+		var disabled *DisabledError
+		if !errors.As(err, &disabled) || disabled.Reason != DisabledBanned || originalURL != "https://evil.example/login" {
+			mt.Errorf("RetrieveURLByPassword = %q, %v; want the destination with a banned error", originalURL, err)
+		}
+	})
+	mt.Run("wrong password", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch, link))
+
+		// Whether it is disabled is not revealed without the password
+		if originalURL, err := RetrieveURLByPassword(context.Background(), "aB3dE5gH", "wrong"); err != ErrInvalidPassword {
+			mt.Errorf("RetrieveURLByPassword = %q, %v; want ErrInvalidPassword", originalURL, err)
+		}
+	})
+}
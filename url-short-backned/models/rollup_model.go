@@ -0,0 +1,395 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	rollupCollection      *mongo.Collection
+	rollupStateCollection *mongo.Collection
+)
+
+const (
+	granularityHour = "hour"
+	granularityDay  = "day"
+
+	// Clicks can sit in the queue for a moment before they are written,
+	// so an hour is only rolled up once this much time has passed after it
+	rollupGracePeriod = 5 * time.Minute
+
+	// Upper bound on the hours rolled up in a single pass
+	rollupMaxHours = 24
+
+	rollupStateID = "clicks"
+)
+
+// clickRollup aggregates the clicks of one short URL over an hour or a
+// day. Human and bot clicks are kept in separate documents.
+type clickRollup struct {
+	ShortURL    string           `bson:"short_url"`
+	Granularity string           `bson:"granularity"`
+	Bucket      time.Time        `bson:"bucket"`
+	Bots        bool             `bson:"bots"`
+	Clicks      int64            `bson:"clicks"`
+	Browsers    map[string]int64 `bson:"browsers"`
+	OS          map[string]int64 `bson:"os"`
+	Devices     map[string]int64 `bson:"devices"`
+}
+
+type rollupKey struct {
+	shortURL string
+	bucket   time.Time
+	bots     bool
+}
+
+// rollupState records how far raw clicks have been rolled up. Every click
+// before RolledUntil is covered by the hourly and daily rollups.
+type rollupState struct {
+	ID          string    `bson:"_id"`
+	RolledUntil time.Time `bson:"rolled_until"`
+}
+
+// StartRollupWorker starts the background job that rolls raw clicks into
+// hourly and daily aggregates
+func StartRollupWorker() {
+	startWorker("rollup", func(stop <-chan struct{}) {
+		ticker := time.NewTicker(settings.RollupInterval)
+		defer ticker.Stop()
+
+		for {
+			ctx, cancel := withAnalyticsTimeout(context.Background())
+			if err := rollUpClicks(ctx); err != nil {
+				slog.Error("Error rolling up clicks", "error", err)
+			}
+			cancel()
+
+			ctx, cancel = withAnalyticsTimeout(context.Background())
+			if err := deleteExpiredAnalytics(ctx); err != nil {
+				slog.Error("Error deleting expired analytics", "error", err)
+			}
+			cancel()
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// rollUpClicks rolls up every complete hour since the last run. Each hour
+// is recomputed from the raw clicks and written with a replace, so running
+// it twice over the same hour (after a crash, a timeout, or from two
+// instances) is harmless.
+func rollUpClicks(ctx context.Context) error {
+	target := time.Now().UTC().Add(-rollupGracePeriod).Truncate(time.Hour)
+
+	start, err := getRolledUntil(ctx)
+	if err != nil {
+		return err
+	}
+	if start.IsZero() {
+		// First run: start from the oldest raw click
+		var oldest Click
+		opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+		err := clickCollection.FindOne(ctx, bson.M{}, opts).Decode(&oldest)
+		if err == mongo.ErrNoDocuments {
+			return setRolledUntil(ctx, target)
+		}
+		if err != nil {
+			return err
+		}
+		start = oldest.Timestamp.UTC().Truncate(time.Hour)
+	}
+
+	for start.Before(target) {
+		end := start.Add(rollupMaxHours * time.Hour)
+		if end.After(target) {
+			end = target
+		}
+		if err := rollUpRange(ctx, start, end); err != nil {
+			return err
+		}
+		if err := setRolledUntil(ctx, end); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// rollUpRange writes the hourly rollups for [start, end) and refreshes the
+// daily rollups of every day it touches
+func rollUpRange(ctx context.Context, start, end time.Time) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": start, "$lt": end}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"short_url": "$short_url",
+				"hour": bson.M{"$dateToString": bson.M{
+					"format": "%Y-%m-%dT%H:00:00Z", "date": "$timestamp", "timezone": "UTC",
+				}},
+				"bots":    "$is_bot",
+				"browser": "$browser",
+				"os":      "$os",
+				"device":  "$device",
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+
+	cursor, err := clickCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	hourly := make(map[rollupKey]*clickRollup)
+	for cursor.Next(ctx) {
+		var group struct {
+			ID struct {
+				ShortURL string `bson:"short_url"`
+				Hour     string `bson:"hour"`
+				Bots     bool   `bson:"bots"`
+				Browser  string `bson:"browser"`
+				OS       string `bson:"os"`
+				Device   string `bson:"device"`
+			} `bson:"_id"`
+			Count int64 `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+		hour, err := time.Parse(time.RFC3339, group.ID.Hour)
+		if err != nil {
+			return err
+		}
+
+		key := rollupKey{shortURL: group.ID.ShortURL, bucket: hour, bots: group.ID.Bots}
+		rollup, ok := hourly[key]
+		if !ok {
+			rollup = newClickRollup(granularityHour, key)
+			hourly[key] = rollup
+		}
+		rollup.Clicks += group.Count
+		rollup.Browsers[group.ID.Browser] += group.Count
+		rollup.OS[group.ID.OS] += group.Count
+		rollup.Devices[group.ID.Device] += group.Count
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if err := replaceRollups(ctx, hourly); err != nil {
+		return err
+	}
+
+	// Rebuild the daily rollups of the touched days from their hourly ones
+	shortURLs := make(map[string]bool)
+	for key := range hourly {
+		shortURLs[key.shortURL] = true
+	}
+	if len(shortURLs) == 0 {
+		return nil
+	}
+	codes := make([]string, 0, len(shortURLs))
+	for code := range shortURLs {
+		codes = append(codes, code)
+	}
+
+	dayStart := start.Truncate(24 * time.Hour)
+	dayEnd := end.Add(-time.Nanosecond).Truncate(24 * time.Hour).Add(24 * time.Hour)
+	hourCursor, err := rollupCollection.Find(ctx, bson.M{
+		"granularity": granularityHour,
+		"short_url":   bson.M{"$in": codes},
+		"bucket":      bson.M{"$gte": dayStart, "$lt": dayEnd},
+	})
+	if err != nil {
+		return err
+	}
+	defer hourCursor.Close(ctx)
+
+	daily := make(map[rollupKey]*clickRollup)
+	for hourCursor.Next(ctx) {
+		var hour clickRollup
+		if err := hourCursor.Decode(&hour); err != nil {
+			return err
+		}
+		key := rollupKey{shortURL: hour.ShortURL, bucket: hour.Bucket.UTC().Truncate(24 * time.Hour), bots: hour.Bots}
+		rollup, ok := daily[key]
+		if !ok {
+			rollup = newClickRollup(granularityDay, key)
+			daily[key] = rollup
+		}
+		rollup.add(&hour)
+	}
+	if err := hourCursor.Err(); err != nil {
+		return err
+	}
+
+	return replaceRollups(ctx, daily)
+}
+
+// deleteExpiredAnalytics removes rollups and visitor sketches older than
+// the configured analytics retention, then the analytics of links whose
+// owners chose a shorter one. Raw clicks expire via their TTL index.
+func deleteExpiredAnalytics(ctx context.Context) error {
+	if settings.AnalyticsRetention > 0 {
+		cutoff := time.Now().UTC().Add(-settings.AnalyticsRetention).Truncate(24 * time.Hour)
+
+		if _, err := rollupCollection.DeleteMany(ctx, bson.M{"bucket": bson.M{"$lt": cutoff}}); err != nil {
+			return err
+		}
+		if err := deleteExpiredVisitorSketches(ctx, cutoff); err != nil {
+			return err
+		}
+	}
+	return deleteExpiredOwnerAnalytics(ctx)
+}
+
+func newClickRollup(granularity string, key rollupKey) *clickRollup {
+	return &clickRollup{
+		ShortURL:    key.shortURL,
+		Granularity: granularity,
+		Bucket:      key.bucket,
+		Bots:        key.bots,
+		Browsers:    map[string]int64{},
+		OS:          map[string]int64{},
+		Devices:     map[string]int64{},
+	}
+}
+
+// add folds the counts of another rollup into r
+func (r *clickRollup) add(other *clickRollup) {
+	r.Clicks += other.Clicks
+	for name, count := range other.Browsers {
+		r.Browsers[name] += count
+	}
+	for name, count := range other.OS {
+		r.OS[name] += count
+	}
+	for name, count := range other.Devices {
+		r.Devices[name] += count
+	}
+}
+
+// replaceRollups upserts rollups, replacing any previous version
+func replaceRollups(ctx context.Context, rollups map[rollupKey]*clickRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(rollups))
+	for _, rollup := range rollups {
+		filter := bson.M{
+			"short_url":   rollup.ShortURL,
+			"granularity": rollup.Granularity,
+			"bucket":      rollup.Bucket,
+			"bots":        rollup.Bots,
+		}
+		writes = append(writes, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(rollup).SetUpsert(true))
+	}
+
+	_, err := rollupCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// getRolledUntil returns the time up to which clicks have been rolled up,
+// or the zero time if the rollup job has never run
+func getRolledUntil(ctx context.Context) (time.Time, error) {
+	var state rollupState
+	err := rollupStateCollection.FindOne(ctx, bson.M{"_id": rollupStateID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return state.RolledUntil.UTC(), nil
+}
+
+// setRolledUntil advances the rollup watermark. It never moves backwards,
+// so a slower instance can't undo the progress of a faster one.
+func setRolledUntil(ctx context.Context, until time.Time) error {
+	_, err := rollupStateCollection.UpdateOne(ctx,
+		bson.M{"_id": rollupStateID},
+		bson.M{"$max": bson.M{"rolled_until": until}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// addRolledClicks adds the rolled-up clicks of the query's short URL in
+// [from, to) to counts. Whole days are read from the daily rollups and the
+// partial days at either end from the hourly ones. A zero from reads from
+// the first rollup.
+func addRolledClicks(ctx context.Context, counts *clickCounts, query StatsQuery, from, to time.Time) error {
+	from, to = from.UTC(), to.UTC()
+
+	var ranges bson.A
+	addRange := func(granularity string, start, end time.Time) {
+		if !start.Before(end) {
+			return
+		}
+		ranges = append(ranges, bson.M{
+			"granularity": granularity,
+			"bucket":      bson.M{"$gte": start, "$lt": end},
+		})
+	}
+
+	firstDay := from.Truncate(24 * time.Hour)
+	if !firstDay.Equal(from) {
+		firstDay = firstDay.Add(24 * time.Hour)
+	}
+	lastDay := to.Truncate(24 * time.Hour)
+	if firstDay.Before(lastDay) {
+		addRange(granularityHour, from, firstDay)
+		addRange(granularityDay, firstDay, lastDay)
+		addRange(granularityHour, lastDay, to)
+	} else {
+		addRange(granularityHour, from, to)
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	filter := bson.M{"short_url": query.ShortURL, "$or": ranges}
+	if !query.IncludeBots {
+		filter["bots"] = false
+	}
+
+	cursor, err := rollupCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var rollup clickRollup
+		if err := cursor.Decode(&rollup); err != nil {
+			return err
+		}
+		counts.total += rollup.Clicks
+		if rollup.Bots {
+			counts.bots += rollup.Clicks
+		}
+		for name, count := range rollup.Browsers {
+			counts.browsers[name] += count
+		}
+		for name, count := range rollup.OS {
+			counts.os[name] += count
+		}
+		for name, count := range rollup.Devices {
+			counts.devices[name] += count
+		}
+		counts.daily[rollup.Bucket.UTC().Format(dayLayout)] += rollup.Clicks
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"url-short-backned/metrics"
+	"url-short-backned/urlcheck"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var linksDisabled = metrics.NewCounterVec("urlshortener_links_disabled_total",
+	"Links disabled, by reason.", "reason")
+
+// StartThreatFeedWorker starts the background goroutine that reloads the
+// threat feeds when their files change and checks every link against them
+// after each change and every recheck interval. Links whose destination
+// becomes listed are disabled, and those it disabled are enabled again
+// once no feed lists them.
+func StartThreatFeedWorker() {
+	startWorker("threat_feeds", func(stop <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		reload := time.NewTicker(settings.ThreatFeedReloadInterval)
+		defer reload.Stop()
+		recheck := time.NewTicker(settings.ThreatRecheckInterval)
+		defer recheck.Stop()
+
+		// Feeds were loaded at startup, but links made before may be listed
+		check := true
+		for {
+			if check {
+				if err := recheckLinks(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("Error checking links against threat feeds", "error", err)
+				}
+			}
+
+			select {
+			case <-reload.C:
+				changed, err := urlcheck.ReloadFeeds()
+				if err != nil {
+					slog.Error("Error reloading threat feeds", "error", err)
+				}
+				if changed {
+					slog.Info("Reloaded threat feeds")
+				}
+				check = changed
+			case <-recheck.C:
+				check = true
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// recheckLinks checks every link against the threat feeds, disabling the
+// newly listed ones and enabling those no longer listed
+func recheckLinks(ctx context.Context) error {
+	// Password-protected links are checked too, under their own field names
+	opts := options.Find().SetProjection(storedLinkProjection)
+	cursor, err := urlCollection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	disabled, enabled := 0, 0
+	for cursor.Next(ctx) {
+		var link storedLink
+		if err := cursor.Decode(&link); err != nil {
+			return err
+		}
+		feed, blocked := urlcheck.Blocked(link.destination())
+		switch {
+		case blocked && link.DisabledReason == "":
+			if err := disableURL(ctx, link.code(), DisabledThreatFeed, feed); err != nil {
+				return err
+			}
+			slog.Warn("Disabled link listed in a threat feed", "short_url", link.code(), "feed", feed)
+			disabled++
+		case !blocked && link.DisabledReason == DisabledThreatFeed:
+			if err := enableURL(ctx, link.code(), DisabledThreatFeed); err != nil {
+				return err
+			}
+			enabled++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if disabled > 0 || enabled > 0 {
+		slog.Info("Checked links against threat feeds", "disabled", disabled, "enabled", enabled)
+	}
+	return nil
+}
+
+// disableURL disables a link for the given reason, unless it already is
+func disableURL(ctx context.Context, shortURL, reason, detail string) error {
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	filter := linkFilter(shortURL)
+	filter["disabled_reason"] = bson.M{"$exists": false}
+	result, err := urlCollection.UpdateOne(queryCtx, filter,
+		bson.M{"$set": bson.M{"disabled_reason": reason, "disabled_detail": detail, "disabled_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		linksDisabled.Inc(reason)
+		InvalidateURL(ctx, shortURL)
+	}
+	return nil
+}
+
+// enableURL enables a link that was disabled for the given reason
+func enableURL(ctx context.Context, shortURL, reason string) error {
+	queryCtx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	filter := linkFilter(shortURL)
+	filter["disabled_reason"] = reason
+	result, err := urlCollection.UpdateOne(queryCtx, filter,
+		bson.M{"$unset": bson.M{"disabled_reason": "", "disabled_detail": "", "disabled_at": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		InvalidateURL(ctx, shortURL)
+	}
+	return nil
+}
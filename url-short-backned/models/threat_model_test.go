@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"url-short-backned/urlcheck"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRecheckProtectedLinks(t *testing.T) {
+	feed := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(feed, []byte("evil.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("disables listed protected links", func(mt *mtest.T) {
+		useMockDatabase(mt)
+		settings.ThreatFeeds = []string{feed}
+		if err := urlcheck.Init(settings); err != nil {
+			mt.Fatal(err)
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.urls", mtest.FirstBatch,
+				bson.D{{Key: "short_url", Value: "safeLink"}, {Key: "original_url", Value: "https://example.com/"}},
+				protectedLink,
+			),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := recheckLinks(context.Background()); err != nil {
+			mt.Fatalf("recheckLinks: %v", err)
+		}
+
+		startedCommand(mt, "find")
+		if !matchesProtected(startedCommand(mt, "update"), "aB3dE5gH") {
+			mt.Error("recheckLinks didn't disable the listed protected link")
+		}
+		if event := mt.GetStartedEvent(); event != nil {
+			mt.Errorf("recheckLinks sent %s for a link no feed lists", event.CommandName)
+		}
+	})
+}
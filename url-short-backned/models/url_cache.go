@@ -0,0 +1,321 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+	"url-short-backned/cache"
+	"url-short-backned/metrics"
+	"url-short-backned/sharedcache"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// Upper bound on the links preloaded by WarmURLCache
+	urlCacheWarmLinks = 1000
+
+	// Shared cache channel announcing short URLs to drop from local caches
+	urlInvalidationChannel = "url-invalidations"
+)
+
+// urlEntry is the cached outcome of a short URL lookup. Unknown short URLs
+// are cached too, so scanners probing random codes don't reach MongoDB.
+type urlEntry struct {
+	originalURL string
+	found       bool
+	disabled    string // Reason the link is disabled, if it is
+}
+
+// entryOf returns the cache entry of a stored link
+func entryOf(url URL) urlEntry {
+	return urlEntry{originalURL: url.OriginalURL, found: true, disabled: url.DisabledReason}
+}
+
+func (e urlEntry) result() (string, error) {
+	if !e.found {
+		return "", ErrNotFound
+	}
+	if e.disabled != "" {
+		return e.originalURL, &DisabledError{Reason: e.disabled}
+	}
+	return e.originalURL, nil
+}
+
+var (
+	urlCache     *cache.LRU[string, urlEntry]
+	urlLoads     singleflight.Group
+	urlCacheWarm atomic.Bool
+
+	urlCacheLookups = metrics.NewCounterVec("urlshortener_url_cache_lookups_total",
+		"Short URL cache lookups, by result (hit, miss or stale).", "result")
+	urlCacheHits     = urlCacheLookups.With("hit")
+	sharedURLLookups = metrics.NewCounterVec("urlshortener_shared_url_cache_lookups_total",
+		"Short URL lookups that missed the local cache and went to the shared cache, by result (hit or miss).", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("urlshortener_url_cache_entries",
+		"Short URL lookups currently cached.",
+		func() float64 { return float64(urlCache.Len()) })
+	metrics.NewCounterFunc("urlshortener_url_cache_evictions_total",
+		"Short URL cache entries evicted to make room.",
+		func() float64 { return float64(urlCache.Evictions()) })
+}
+
+// cacheURL stores the outcome of a lookup with the TTL for its kind
+func cacheURL(shortURL string, entry urlEntry) {
+	ttl := settings.URLCacheTTL
+	if !entry.found {
+		ttl = settings.URLCacheNegativeTTL
+	}
+	urlCache.Add(shortURL, entry, ttl)
+}
+
+// storeURL caches a link just written to MongoDB, locally and in the
+// shared cache, and tells other instances to drop what they hold for it
+func storeURL(ctx context.Context, shortURL string, entry urlEntry) {
+	addToURLFilter(shortURL)
+	cacheURL(shortURL, entry)
+	shareURL(ctx, shortURL, entry)
+	if err := sharedcache.Publish(ctx, urlInvalidationChannel, shortURL); err != nil {
+		slog.WarnContext(ctx, "Error broadcasting URL invalidation", "short_url", shortURL, "error", err)
+	}
+}
+
+// InvalidateURL drops a short URL from the local and shared caches and
+// from those of every other instance. It must be called whenever a link
+// is edited or deleted.
+func InvalidateURL(ctx context.Context, shortURL string) {
+	urlLoads.Forget(shortURL)
+	urlCache.Remove(shortURL)
+
+	if err := sharedcache.Delete(ctx, sharedURLKey(shortURL)); err != nil {
+		slog.WarnContext(ctx, "Error invalidating shared URL cache", "short_url", shortURL, "error", err)
+	}
+	if err := sharedcache.Publish(ctx, urlInvalidationChannel, shortURL); err != nil {
+		slog.WarnContext(ctx, "Error broadcasting URL invalidation", "short_url", shortURL, "error", err)
+	}
+}
+
+// StartInvalidationListener starts the background goroutine that drops
+// the short URLs other instances announce from the local cache. It does
+// nothing without a shared cache.
+func StartInvalidationListener() {
+	if !sharedcache.Enabled() {
+		return
+	}
+
+	startWorker("invalidations", func(stop <-chan struct{}) {
+		sub := sharedcache.Subscribe(context.Background(), urlInvalidationChannel)
+		defer sub.Close()
+
+		for {
+			select {
+			case shortURL, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				// The code may be new, so the filter must know it too
+				addToURLFilter(shortURL)
+				urlLoads.Forget(shortURL)
+				urlCache.Remove(shortURL)
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// loadURL resolves a short URL missing from the local cache, first from
+// the shared cache and then from MongoDB, and caches the outcome.
+// Concurrent misses on the same short URL share one load, which is
+// detached from the cancellation of the caller that started it.
+func loadURL(ctx context.Context, shortURL string) (urlEntry, error) {
+	results := urlLoads.DoChan(shortURL, func() (interface{}, error) {
+		ctx := context.WithoutCancel(ctx)
+		if entry, ok := sharedURL(ctx, shortURL); ok {
+			cacheURL(shortURL, entry)
+			return entry, nil
+		}
+
+		entry, err := findURL(ctx, shortURL)
+		if err != nil {
+			return entry, err
+		}
+		cacheURL(shortURL, entry)
+		shareURL(ctx, shortURL, entry)
+		return entry, nil
+	})
+
+	select {
+	case result := <-results:
+		return result.Val.(urlEntry), result.Err
+	case <-ctx.Done():
+		return urlEntry{}, ctx.Err()
+	}
+}
+
+func sharedURLKey(shortURL string) string {
+	return "url:" + shortURL
+}
+
+// sharedURL reads a lookup from the shared cache. Shared cache errors
+// count as misses.
+func sharedURL(ctx context.Context, shortURL string) (urlEntry, bool) {
+	if !sharedcache.Enabled() {
+		return urlEntry{}, false
+	}
+
+	value, ok, err := sharedcache.Get(ctx, sharedURLKey(shortURL))
+	if err != nil {
+		slog.DebugContext(ctx, "Error reading shared URL cache", "short_url", shortURL, "error", err)
+	}
+	if !ok {
+		sharedURLLookups.Inc("miss")
+		return urlEntry{}, false
+	}
+	sharedURLLookups.Inc("hit")
+
+	// Found links are stored as "1" followed by the URL, disabled ones as
+	// "2" followed by the reason, a newline and the URL, and unknown ones
+	// as "0"
+	if originalURL, found := strings.CutPrefix(value, "1"); found {
+		return urlEntry{originalURL: originalURL, found: true}, true
+	}
+	if rest, found := strings.CutPrefix(value, "2"); found {
+		reason, originalURL, _ := strings.Cut(rest, "\n")
+		return urlEntry{originalURL: originalURL, found: true, disabled: reason}, true
+	}
+	return urlEntry{}, true
+}
+
+// shareURL writes a lookup to the shared cache with the TTL for its kind
+func shareURL(ctx context.Context, shortURL string, entry urlEntry) {
+	if !sharedcache.Enabled() {
+		return
+	}
+
+	value, ttl := "0", settings.URLCacheNegativeTTL
+	switch {
+	case entry.found && entry.disabled != "":
+		value, ttl = "2"+entry.disabled+"\n"+entry.originalURL, settings.URLCacheTTL
+	case entry.found:
+		value, ttl = "1"+entry.originalURL, settings.URLCacheTTL
+	}
+	if err := sharedcache.Set(ctx, sharedURLKey(shortURL), value, ttl); err != nil {
+		slog.DebugContext(ctx, "Error writing shared URL cache", "short_url", shortURL, "error", err)
+	}
+}
+
+// findURL looks a short URL up in MongoDB
+func findURL(ctx context.Context, shortURL string) (urlEntry, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var url URL
+	err := urlCollection.FindOne(ctx, bson.M{"short_url": shortURL}).Decode(&url)
+	if err == mongo.ErrNoDocuments {
+		return urlEntry{}, nil
+	}
+	if err != nil {
+		return urlEntry{}, err
+	}
+	return entryOf(url), nil
+}
+
+// WarmURLCache preloads the cache with the links clicked most over the
+// last day, so a fresh instance doesn't send its first wave of redirects
+// to MongoDB. URLCacheWarmed reports true once it has run, even if it
+// failed, since the cache still fills as redirects come in.
+func WarmURLCache(ctx context.Context) {
+	defer urlCacheWarm.Store(true)
+	if urlCache == nil {
+		return
+	}
+
+	ctx, cancel := withAnalyticsTimeout(ctx)
+	defer cancel()
+
+	limit := min(urlCacheWarmLinks, settings.URLCacheSize)
+	shortURLs, err := hottestShortURLs(ctx, time.Now().UTC().Add(-24*time.Hour), limit)
+	if err != nil {
+		slog.Warn("Error warming URL cache", "error", err)
+		return
+	}
+	if len(shortURLs) == 0 {
+		return
+	}
+
+	cursor, err := urlCollection.Find(ctx, bson.M{"short_url": bson.M{"$in": shortURLs}})
+	if err != nil {
+		slog.Warn("Error warming URL cache", "error", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	warmed := 0
+	for cursor.Next(ctx) {
+		var url URL
+		if err := cursor.Decode(&url); err != nil {
+			slog.Warn("Error warming URL cache", "error", err)
+			return
+		}
+		cacheURL(url.ShortURL, entryOf(url))
+		warmed++
+	}
+	if err := cursor.Err(); err != nil {
+		slog.Warn("Error warming URL cache", "error", err)
+		return
+	}
+	slog.Info("Warmed URL cache", "links", warmed)
+}
+
+// URLCacheWarmed reports whether WarmURLCache has run
+func URLCacheWarmed() bool {
+	return urlCacheWarm.Load()
+}
+
+// hottestShortURLs returns up to limit short URLs with the most human
+// clicks in the hourly rollups since the given time, busiest first
+func hottestShortURLs(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"granularity": granularityHour,
+			"bots":        false,
+			"bucket":      bson.M{"$gte": since.Truncate(time.Hour)},
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": "$short_url", "clicks": bson.M{"$sum": "$clicks"}}}},
+		{{Key: "$sort", Value: bson.M{"clicks": -1}}},
+		{{Key: "$limit", Value: limit}},
+	}
+
+	cursor, err := rollupCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		ShortURL string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	shortURLs := make([]string, len(results))
+	for i, result := range results {
+		shortURLs[i] = result.ShortURL
+	}
+	return shortURLs, nil
+}
+
+// PrimeURLCache caches a link in this instance only, as if it had just
+// been looked up. It is meant for benchmarks and tools that run without
+// MongoDB.
+func PrimeURLCache(shortURL, originalURL string) {
+	addToURLFilter(shortURL)
+	cacheURL(shortURL, urlEntry{originalURL: originalURL, found: true})
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+	"url-short-backned/cache"
+	"url-short-backned/config"
+	"url-short-backned/sharedcache"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// setupSharedCache runs the models against a fresh in-process shared
+// cache, with an empty local cache
+func setupSharedCache(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	settings = config.Default()
+	settings.RedisURL = "redis://" + server.Addr()
+	urlCache = cache.New[string, urlEntry](settings.URLCacheSize)
+	if err := sharedcache.Init(context.Background(), settings); err != nil {
+		t.Fatalf("sharedcache.Init: %v", err)
+	}
+	t.Cleanup(sharedcache.Close)
+	return server
+}
+
+func TestSharedURLEncoding(t *testing.T) {
+	server := setupSharedCache(t)
+	ctx := context.Background()
+	key := settings.RedisKeyPrefix + sharedURLKey("abc")
+
+	tests := []struct {
+		name  string
+		entry urlEntry
+		value string
+		ttl   time.Duration
+	}{
+		{"found", urlEntry{originalURL: "https://example.com/", found: true}, "1https://example.com/", settings.URLCacheTTL},
+		{"disabled", urlEntry{originalURL: "https://example.com/", found: true, disabled: DisabledThreatFeed},
+			"2threat_feed\nhttps://example.com/", settings.URLCacheTTL},
+		{"unknown", urlEntry{}, "0", settings.URLCacheNegativeTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shareURL(ctx, "abc", tt.entry)
+
+			value, err := server.Get(key)
+			if err != nil || value != tt.value {
+				t.Errorf("stored %q, %v; want %q", value, err, tt.value)
+			}
+			if ttl := server.TTL(key); ttl != tt.ttl {
+				t.Errorf("stored with TTL %v; want %v", ttl, tt.ttl)
+			}
+
+			entry, ok := sharedURL(ctx, "abc")
+			if !ok || entry != tt.entry {
+				t.Errorf("sharedURL = %+v, %v; want %+v", entry, ok, tt.entry)
+			}
+		})
+	}
+}
+
+func TestSharedURLMiss(t *testing.T) {
+	server := setupSharedCache(t)
+	ctx := context.Background()
+
+	if _, ok := sharedURL(ctx, "abc"); ok {
+		t.Error("sharedURL found a code that was never shared")
+	}
+
+	// An unreachable shared cache counts as a miss
+	shareURL(ctx, "abc", urlEntry{originalURL: "https://example.com/", found: true})
+	server.SetError("server is down")
+	if _, ok := sharedURL(ctx, "abc"); ok {
+		t.Error("sharedURL found a code while the shared cache failed")
+	}
+}
+
+func TestInvalidationListener(t *testing.T) {
+	server := setupSharedCache(t)
+	ctx := context.Background()
+	channel := settings.RedisKeyPrefix + urlInvalidationChannel
+
+	StartInvalidationListener()
+	t.Cleanup(func() { StopWorkers(context.Background()) })
+	for deadline := time.Now().Add(2 * time.Second); server.PubSubNumSub(channel)[channel] == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("listener never subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Another instance changes a link this one has cached
+	cacheURL("abc", urlEntry{originalURL: "https://example.com/", found: true})
+	cacheURL("def", urlEntry{originalURL: "https://example.org/", found: true})
+	if err := sharedcache.Publish(ctx, urlInvalidationChannel, "abc"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if _, ok := urlCache.Peek("abc"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("invalidated link is still cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := urlCache.Peek("def"); !ok {
+		t.Error("a link that was not invalidated was dropped")
+	}
+}
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+	"url-short-backned/sharedcache"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var changeStreamStateCollection *mongo.Collection
+
+const (
+	// Minimum time between saves of the change stream position
+	resumeTokenSaveInterval = 5 * time.Second
+
+	// Wait before reopening a change stream that failed
+	changeStreamRetryDelay = 5 * time.Second
+
+	// Short URLs checked per query when polling
+	urlPollBatchSize = 500
+
+	// Server error codes of change streams
+	errCodeChangeStreamUnsupported = 40573
+	errCodeChangeStreamHistoryLost = 286
+)
+
+// changeStreamState is the last change stream position an instance
+// processed, so it resumes from there after a restart
+type changeStreamState struct {
+	InstanceID  string    `bson:"_id"`
+	ResumeToken bson.Raw  `bson:"resume_token"`
+	SavedAt     time.Time `bson:"saved_at"`
+}
+
+// urlChange is the part of a change event the cache needs
+type urlChange struct {
+	OperationType            string `bson:"operationType"`
+	FullDocument             *URL   `bson:"fullDocument"`
+	FullDocumentBeforeChange *URL   `bson:"fullDocumentBeforeChange"`
+}
+
+// StartURLChangeWatcher starts the background goroutine that keeps the URL
+// caches in step with the links collection. It follows a change stream,
+// or polls the cached links when the server doesn't support change
+// streams.
+func StartURLChangeWatcher() {
+	startWorker("url_changes", func(stop <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			err := watchURLChanges(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if hasErrorCode(err, errCodeChangeStreamUnsupported) {
+				slog.Info("Change streams are not available, polling cached links instead", "interval", settings.URLCachePollInterval)
+				pollURLChanges(ctx)
+				return
+			}
+			slog.Warn("URL change stream failed, reopening", "retry_in", changeStreamRetryDelay, "error", err)
+
+			select {
+			case <-time.After(changeStreamRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// watchURLChanges follows the links collection from the saved position
+// and drops every changed link from the caches, until ctx ends or the
+// stream fails
+func watchURLChanges(ctx context.Context) error {
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+
+	token, err := loadResumeToken(ctx)
+	if err != nil {
+		return err
+	}
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+
+	stream, err := urlCollection.Watch(ctx, mongo.Pipeline{}, opts)
+	if token != nil && hasErrorCode(err, errCodeChangeStreamHistoryLost) {
+		// Changes were missed, so nothing cached can be trusted
+		slog.Warn("Saved change stream position is too old, starting over")
+		urlCache.Purge()
+		if err := saveResumeToken(ctx, nil); err != nil {
+			return err
+		}
+		// The filter missed the links created meanwhile too. Until it is
+		// rebuilt, lookups go to MongoDB.
+		if settings.URLFilter {
+			filterCtx, cancel := withAnalyticsTimeout(ctx)
+			if err := rebuildURLFilter(filterCtx); err != nil {
+				slog.Warn("Error rebuilding URL filter, disabling it until the next rebuild", "error", err)
+				dropURLFilter()
+			}
+			cancel()
+		}
+		return watchURLChanges(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	setURLFilterFollowed(true)
+
+	lastSave := time.Now()
+	for stream.Next(ctx) {
+		var change urlChange
+		if err := stream.Decode(&change); err != nil {
+			setURLFilterFollowed(false)
+			return err
+		}
+		applyURLChange(ctx, change)
+
+		if time.Since(lastSave) >= resumeTokenSaveInterval {
+			if err := saveResumeToken(ctx, stream.ResumeToken()); err != nil {
+				slog.Warn("Error saving change stream position", "error", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+
+	// Links created elsewhere are missed until the stream is reopened
+	setURLFilterFollowed(false)
+
+	// Keep the position for the next run, even when stopping
+	saveCtx, cancel := withQueryTimeout(context.WithoutCancel(ctx))
+	defer cancel()
+	if err := saveResumeToken(saveCtx, stream.ResumeToken()); err != nil {
+		slog.Warn("Error saving change stream position", "error", err)
+	}
+	return stream.Err()
+}
+
+// applyURLChange drops the link a change event is about from the caches.
+// Every instance follows the stream, so nothing is broadcast.
+func applyURLChange(ctx context.Context, change urlChange) {
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		if change.FullDocument != nil {
+			addToURLFilter(change.FullDocument.ShortURL)
+			dropCachedURL(ctx, change.FullDocument.ShortURL)
+			return
+		}
+	case "delete":
+		if change.FullDocumentBeforeChange != nil {
+			dropCachedURL(ctx, change.FullDocumentBeforeChange.ShortURL)
+			return
+		}
+	}
+
+	// The link can't be told (a delete without pre-images, a dropped
+	// collection), so nothing cached can be trusted
+	slog.Debug("Purging URL cache after an unattributable change", "operation", change.OperationType)
+	urlCache.Purge()
+}
+
+// dropCachedURL removes a short URL from the local and shared caches
+func dropCachedURL(ctx context.Context, shortURL string) {
+	urlLoads.Forget(shortURL)
+	urlCache.Remove(shortURL)
+	if err := sharedcache.Delete(ctx, sharedURLKey(shortURL)); err != nil {
+		slog.DebugContext(ctx, "Error invalidating shared URL cache", "short_url", shortURL, "error", err)
+	}
+}
+
+// pollURLChanges rechecks the cached links every poll interval until ctx
+// ends
+func pollURLChanges(ctx context.Context) {
+	ticker := time.NewTicker(settings.URLCachePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := revalidateCachedURLs(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("Error checking cached links", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// revalidateCachedURLs compares every cached link, negative entries
+// included, with MongoDB and drops those that changed
+func revalidateCachedURLs(ctx context.Context) error {
+	shortURLs := urlCache.Keys()
+	for start := 0; start < len(shortURLs); start += urlPollBatchSize {
+		batch := shortURLs[start:min(start+urlPollBatchSize, len(shortURLs))]
+
+		current, err := findURLs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, shortURL := range batch {
+			cached, ok := urlCache.Peek(shortURL)
+			if !ok {
+				continue
+			}
+			if current[shortURL] != cached {
+				dropCachedURL(ctx, shortURL)
+			}
+		}
+	}
+	return nil
+}
+
+// findURLs returns the cache entries of those short URLs that exist
+func findURLs(ctx context.Context, shortURLs []string) (map[string]urlEntry, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	cursor, err := urlCollection.Find(ctx, bson.M{"short_url": bson.M{"$in": shortURLs}})
+	if err != nil {
+		return nil, err
+	}
+	var urls []URL
+	if err := cursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]urlEntry, len(urls))
+	for _, url := range urls {
+		found[url.ShortURL] = entryOf(url)
+	}
+	return found, nil
+}
+
+// loadResumeToken returns this instance's saved change stream position,
+// or nil if there is none
+func loadResumeToken(ctx context.Context) (bson.Raw, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var state changeStreamState
+	err := changeStreamStateCollection.FindOne(ctx, bson.M{"_id": settings.InstanceID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return state.ResumeToken, err
+}
+
+// saveResumeToken records this instance's change stream position. A nil
+// token forgets it.
+func saveResumeToken(ctx context.Context, token bson.Raw) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	if token == nil {
+		_, err := changeStreamStateCollection.DeleteOne(ctx, bson.M{"_id": settings.InstanceID})
+		return err
+	}
+	_, err := changeStreamStateCollection.ReplaceOne(ctx,
+		bson.M{"_id": settings.InstanceID},
+		changeStreamState{InstanceID: settings.InstanceID, ResumeToken: token, SavedAt: time.Now()},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// hasErrorCode reports whether err is a server error with the given code
+func hasErrorCode(err error, code int) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(code)
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+	"url-short-backned/metrics"
+	"url-short-backned/sharedcache"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// False positive rate the URL filter is sized for
+	urlFilterFalsePositiveRate = 0.01
+
+	// The filter is sized for this many times the current links, and for
+	// no fewer than urlFilterMinLinks, so it stays accurate until rebuilt
+	urlFilterHeadroom = 2
+	urlFilterMinLinks = 100000
+
+	// Wait before retrying a failed build
+	urlFilterRetryDelay = 30 * time.Second
+)
+
+// urlFilter is a Bloom filter of every existing short URL. Lookups for
+// codes it has never seen, typically from bots scanning random codes, are
+// answered without a MongoDB round trip.
+var urlFilter struct {
+	mu     sync.RWMutex
+	filter *utils.BloomFilter // Nil until first built
+
+	// Whether a change stream brings the filter the links other instances
+	// create. Without one, or a shared cache announcing them, the filter
+	// only knows the links that existed when it was built.
+	followed bool
+
+	// Codes added while a rebuild scans the collection, which the scan
+	// may have missed
+	rebuilding bool
+	pending    []string
+}
+
+var urlFilterRejections = metrics.NewCounterVec("urlshortener_url_filter_rejections_total",
+	"Short URL lookups answered as unknown by the Bloom filter without querying MongoDB.")
+
+// StartURLFilterWorker starts the background goroutine that builds the
+// URL filter and rebuilds it periodically, so its false positive rate
+// stays in check as links are added. It does nothing when the filter is
+// disabled.
+func StartURLFilterWorker() {
+	if !settings.URLFilter {
+		return
+	}
+
+	startWorker("url_filter", func(stop <-chan struct{}) {
+		for {
+			wait := settings.URLFilterRebuildInterval
+			ctx, cancel := withAnalyticsTimeout(context.Background())
+			if err := rebuildURLFilter(ctx); err != nil {
+				slog.Warn("Error building URL filter", "retry_in", urlFilterRetryDelay, "error", err)
+				wait = urlFilterRetryDelay
+			}
+			cancel()
+
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// rebuildURLFilter builds a fresh filter from the links collection and
+// swaps it in
+func rebuildURLFilter(ctx context.Context) error {
+	count, err := urlCollection.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return err
+	}
+
+	urlFilter.mu.Lock()
+	urlFilter.rebuilding, urlFilter.pending = true, nil
+	urlFilter.mu.Unlock()
+	defer func() {
+		urlFilter.mu.Lock()
+		urlFilter.rebuilding, urlFilter.pending = false, nil
+		urlFilter.mu.Unlock()
+	}()
+
+	filter := utils.NewBloomFilter(max(int(count)*urlFilterHeadroom, urlFilterMinLinks), urlFilterFalsePositiveRate)
+	opts := options.Find().SetProjection(bson.M{"_id": 0, "short_url": 1})
+	cursor, err := urlCollection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	added := 0
+	for cursor.Next(ctx) {
+		var url struct {
+			ShortURL string `bson:"short_url"`
+		}
+		if err := cursor.Decode(&url); err != nil {
+			return err
+		}
+		filter.Add(url.ShortURL)
+		added++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	urlFilter.mu.Lock()
+	for _, shortURL := range urlFilter.pending {
+		filter.Add(shortURL)
+	}
+	urlFilter.filter = filter
+	urlFilter.mu.Unlock()
+
+	slog.Info("Built URL filter", "links", added)
+	return nil
+}
+
+// addToURLFilter records a short URL that was just created, here or on
+// another instance
+func addToURLFilter(shortURL string) {
+	urlFilter.mu.Lock()
+	defer urlFilter.mu.Unlock()
+
+	if urlFilter.filter != nil {
+		urlFilter.filter.Add(shortURL)
+	}
+	if urlFilter.rebuilding {
+		urlFilter.pending = append(urlFilter.pending, shortURL)
+	}
+}
+
+// dropURLFilter discards a filter that may be missing links
+func dropURLFilter() {
+	urlFilter.mu.Lock()
+	defer urlFilter.mu.Unlock()
+	urlFilter.filter = nil
+}
+
+// setURLFilterFollowed records whether a change stream is adding the
+// links other instances create to the filter
+func setURLFilterFollowed(followed bool) {
+	urlFilter.mu.Lock()
+	defer urlFilter.mu.Unlock()
+	urlFilter.followed = followed
+}
+
+// urlDefinitelyMissing reports whether the filter is sure a short URL does
+// not exist. It is false until the filter has been built, and while links
+// created on other instances may not have reached it.
+func urlDefinitelyMissing(shortURL string) bool {
+	urlFilter.mu.RLock()
+	defer urlFilter.mu.RUnlock()
+	if !urlFilter.followed && !sharedcache.Enabled() {
+		return false
+	}
+	return urlFilter.filter != nil && !urlFilter.filter.MayContain(shortURL)
+}
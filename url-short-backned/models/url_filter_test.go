@@ -0,0 +1,42 @@
+package models
+
+import (
+	"testing"
+	"url-short-backned/utils"
+)
+
+func TestURLDefinitelyMissing(t *testing.T) {
+	t.Cleanup(func() {
+		dropURLFilter()
+		setURLFilterFollowed(false)
+	})
+
+	if urlDefinitelyMissing("zzzzzzzz") {
+		t.Error("a code was rejected before the filter was built")
+	}
+
+	urlFilter.mu.Lock()
+	urlFilter.filter = utils.NewBloomFilter(1000, urlFilterFalsePositiveRate)
+	urlFilter.mu.Unlock()
+	addToURLFilter("abcdefgh")
+
+	// Without a change stream or a shared cache, links created on other
+	// instances never reach the filter
+	if urlDefinitelyMissing("zzzzzzzz") {
+		t.Error("a code was rejected while the filter was not followed")
+	}
+
+	setURLFilterFollowed(true)
+	if !urlDefinitelyMissing("zzzzzzzz") {
+		t.Error("an unknown code was not rejected while the filter was followed")
+	}
+	if urlDefinitelyMissing("abcdefgh") {
+		t.Error("a known code was rejected")
+	}
+
+	setURLFilterFollowed(false)
+	setupSharedCache(t)
+	if !urlDefinitelyMissing("zzzzzzzz") {
+		t.Error("an unknown code was not rejected with a shared cache")
+	}
+}
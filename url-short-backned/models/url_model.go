@@ -2,40 +2,218 @@ package models
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"time"
 	"url-short-backned/config"
+	"url-short-backned/tracing"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var urlCollection *mongo.Collection = config.Client.Database("urlShortener").Collection("urls")
+var urlCollection *mongo.Collection
+
+// Reasons a link is disabled for
+const (
+	// DisabledThreatFeed marks a link whose destination is listed in a
+	// threat feed. It is enabled again once the feeds no longer list it.
+	DisabledThreatFeed = "threat_feed"
+)
 
 type URL struct {
 	ShortURL    string    `bson:"short_url"`
 	OriginalURL string    `bson:"original_url"`
 	CreatedAt   time.Time `bson:"created_at"`
+
+	// Owner is the API key or user that created the link, as returned by
+	// ratelimit.Owner. It is empty for links created anonymously.
+	Owner string `bson:"owner,omitempty"`
+
+	// DisabledReason is set while the link is disabled, and
+	// DisabledDetail says more, such as the feed that listed it
+	DisabledReason string    `bson:"disabled_reason,omitempty"`
+	DisabledDetail string    `bson:"disabled_detail,omitempty"`
+	DisabledAt     time.Time `bson:"disabled_at,omitempty"`
+}
+
+// storedLink is a link of either kind, as moderation and the threat feed
+// recheck read it. Password-protected links are stored in the same
+// collection, with their fields spelt differently.
+type storedLink struct {
+	ShortURL             string `bson:"short_url"`
+	OriginalURL          string `bson:"original_url"`
+	ProtectedShortURL    string `bson:"shortURL"`
+	ProtectedOriginalURL string `bson:"originalURL"`
+	DisabledReason       string `bson:"disabled_reason,omitempty"`
+
+	// CreatedAt is zero for password-protected links stored before they
+	// recorded it
+	CreatedAt time.Time `bson:"created_at,omitempty"`
+	Owner     string    `bson:"owner,omitempty"`
+}
+
+// code returns the short code of the link
+func (l storedLink) code() string {
+	if l.ShortURL != "" {
+		return l.ShortURL
+	}
+	return l.ProtectedShortURL
+}
+
+// protected reports whether the link is password-protected
+func (l storedLink) protected() bool {
+	return l.ShortURL == "" && l.ProtectedShortURL != ""
 }
 
-func SaveURL(shortURL, originalURL string) error {
+// destination returns the original URL of the link
+func (l storedLink) destination() string {
+	if l.OriginalURL != "" {
+		return l.OriginalURL
+	}
+	return l.ProtectedOriginalURL
+}
+
+// linkFilter matches the link with the given short code, whether it is
+// password-protected or not
+func linkFilter(shortURL string) bson.M {
+	return bson.M{"$or": bson.A{bson.M{"short_url": shortURL}, bson.M{"shortURL": shortURL}}}
+}
+
+// storedLinkProjection projects the fields storedLink reads
+var storedLinkProjection = bson.M{
+	"short_url": 1, "original_url": 1, "shortURL": 1, "originalURL": 1, "disabled_reason": 1,
+}
+
+func SaveURL(ctx context.Context, shortURL, originalURL, owner string) (err error) {
+	ctx, span := tracing.Start(ctx, "models.SaveURL", attribute.String("short_url", shortURL))
+	defer tracing.End(span, &err)
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	url := URL{
 		ShortURL:    shortURL,
 		OriginalURL: originalURL,
 		CreatedAt:   time.Now(),
+		Owner:       owner,
 	}
-	if _, err := urlCollection.InsertOne(context.Background(), url); err != nil {
-		log.Printf("Error saving URL: %v", err)
+	if _, err := urlCollection.InsertOne(ctx, url); err != nil {
+		slog.ErrorContext(ctx, "Error saving URL", "short_url", shortURL, "error", err)
 		return err 
 	}
+
+	// Replace any negative entry left by a lookup before the link existed
+	storeURL(ctx, shortURL, urlEntry{originalURL: originalURL, found: true})
 	return nil
 }
 
-func GetURL(shortURL string) (string, bool) {
+// GetURLOwner returns the owner of a short URL, or ErrNotFound
+func GetURLOwner(ctx context.Context, shortURL string) (string, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	var url URL
-	if err := urlCollection.FindOne(context.Background(), bson.M{"short_url": shortURL}).Decode(&url); err != nil {
-		log.Printf("Error retrieving URL: %v", err)
-		return "", false
+	err := urlCollection.FindOne(ctx, bson.M{"short_url": shortURL},
+		options.FindOne().SetProjection(bson.M{"owner": 1})).Decode(&url)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrNotFound
 	}
-	return url.OriginalURL, true
-}
\ No newline at end of file
+	return url.Owner, err
+}
+
+// OwnedURLs returns the short URLs of the links created by owner, oldest
+// first, password-protected or not
+func OwnedURLs(ctx context.Context, owner string) ([]string, error) {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	links, err := ownedLinks(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	return shortURLsOf(links), nil
+}
+
+// ownedLinks returns the links created by owner, oldest first
+func ownedLinks(ctx context.Context, owner string) ([]storedLink, error) {
+	projection := bson.M{"created_at": 1}
+	for field := range storedLinkProjection {
+		projection[field] = 1
+	}
+	opts := options.Find().
+		SetProjection(projection).
+		SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := urlCollection.Find(ctx, bson.M{"owner": owner}, opts)
+	if err != nil {
+		return nil, err
+	}
+	links := []storedLink{}
+	if err := cursor.All(ctx, &links); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// shortURLsOf returns the short codes of links
+func shortURLsOf(links []storedLink) []string {
+	shortURLs := make([]string, len(links))
+	for i, link := range links {
+		shortURLs[i] = link.code()
+	}
+	return shortURLs
+}
+
+// GetURL returns the original URL of a short URL, or ErrNotFound. For a
+// disabled link it returns the original URL with a *DisabledError. Lookups
+// are served from the URL cache when possible, and from expired cache
+// entries while MongoDB is unreachable.
+func GetURL(ctx context.Context, shortURL string) (string, error) {
+	// Answered from memory without a span: these are most lookups, and a
+	// span would cost more than the lookup itself
+	if entry, ok := urlCache.Get(shortURL); ok {
+		urlCacheHits.Inc()
+		return entry.result()
+	}
+	if urlDefinitelyMissing(shortURL) {
+		urlFilterRejections.Inc()
+		return "", ErrNotFound
+	}
+	return lookupURL(ctx, shortURL)
+}
+
+// lookupURL looks up a short URL that is not in the local cache
+func lookupURL(ctx context.Context, shortURL string) (originalURL string, err error) {
+	ctx, span := tracing.Start(ctx, "models.GetURL", attribute.String("short_url", shortURL))
+	defer func() {
+		var disabled *DisabledError
+		if err == ErrNotFound || errors.As(err, &disabled) {
+			span.End()
+			return
+		}
+		tracing.End(span, &err)
+	}()
+
+	// Don't wait for MongoDB to time out when it is known to be down
+	if !config.MongoAvailable() {
+		if entry, ok := urlCache.GetStale(shortURL); ok {
+			urlCacheLookups.Inc("stale")
+			span.SetAttributes(attribute.String("cache", "stale"))
+			return entry.result()
+		}
+	}
+
+	urlCacheLookups.Inc("miss")
+	span.SetAttributes(attribute.String("cache", "miss"))
+	entry, err := loadURL(ctx, shortURL)
+	if err != nil {
+		if entry, ok := urlCache.GetStale(shortURL); ok && IsUnavailable(err) {
+			urlCacheLookups.Inc("stale")
+			return entry.result()
+		}
+		slog.ErrorContext(ctx, "Error retrieving URL", "short_url", shortURL, "error", err)
+		return "", err
+	}
+	return entry.result()
+}
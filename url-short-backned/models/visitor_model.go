@@ -0,0 +1,174 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+	"url-short-backned/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var visitorCollection *mongo.Collection
+
+const (
+	dayLayout           = "2006-01-02"
+	sketchMergeAttempts = 5
+)
+
+// visitorSketch is the stored unique-visitor sketch of one short URL for
+// one UTC day. Human and bot visitors are kept in separate sketches.
+type visitorSketch struct {
+	ShortURL  string `bson:"short_url"`
+	Day       string `bson:"day"`
+	Bots      bool   `bson:"bots"`
+	Registers []byte `bson:"registers"`
+	Version   int64  `bson:"version"`
+}
+
+type sketchKey struct {
+	shortURL string
+	day      string
+	bots     bool
+}
+
+// addVisitors folds a batch of clicks into their daily sketches and
+// merges them into the stored ones
+func addVisitors(clicks []Click) {
+	sketches := make(map[sketchKey]*utils.HyperLogLog)
+	for _, click := range clicks {
+		if click.VisitorHash == 0 {
+			continue
+		}
+		key := sketchKey{
+			shortURL: click.ShortURL,
+			day:      click.Timestamp.UTC().Format(dayLayout),
+			bots:     click.IsBot,
+		}
+		sketch, ok := sketches[key]
+		if !ok {
+			sketch = utils.NewHyperLogLog()
+			sketches[key] = sketch
+		}
+		sketch.Add(click.VisitorHash)
+	}
+
+	for key, sketch := range sketches {
+		ctx, cancel := withQueryTimeout(context.Background())
+		err := mergeVisitorSketch(ctx, key, sketch)
+		cancel()
+		if err != nil {
+			slog.Error("Error saving visitor sketch", "short_url", key.shortURL, "day", key.day, "error", err)
+		}
+	}
+}
+
+// mergeVisitorSketch merges sketch into the stored sketch for key. Writes
+// are guarded by a version number so concurrent merges from several
+// instances retry instead of overwriting each other.
+func mergeVisitorSketch(ctx context.Context, key sketchKey, sketch *utils.HyperLogLog) error {
+	filter := bson.M{"short_url": key.shortURL, "day": key.day, "bots": key.bots}
+
+	for attempt := 0; attempt < sketchMergeAttempts; attempt++ {
+		var stored visitorSketch
+		err := visitorCollection.FindOne(ctx, filter).Decode(&stored)
+		if err == mongo.ErrNoDocuments {
+			_, err = visitorCollection.InsertOne(ctx, visitorSketch{
+				ShortURL:  key.shortURL,
+				Day:       key.day,
+				Bots:      key.bots,
+				Registers: sketch.Bytes(),
+				Version:   1,
+			})
+			if mongo.IsDuplicateKeyError(err) {
+				continue // Another instance created it first
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		merged, err := utils.HyperLogLogFromBytes(stored.Registers)
+		if err != nil {
+			return err
+		}
+		merged.Merge(sketch)
+
+		versioned := bson.M{"short_url": key.shortURL, "day": key.day, "bots": key.bots, "version": stored.Version}
+		result, err := visitorCollection.UpdateOne(ctx, versioned, bson.M{
+			"$set": bson.M{"registers": merged.Bytes(), "version": stored.Version + 1},
+		})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 1 {
+			return nil
+		}
+	}
+	return errors.New("too many concurrent sketch updates")
+}
+
+// CountUniqueVisitors estimates the distinct visitors of a short URL between
+// two UTC days (inclusive, formatted as 2006-01-02; empty means unbounded).
+// It returns the count for the whole range and for each day.
+func CountUniqueVisitors(ctx context.Context, shortURL, fromDay, toDay string, includeBots bool) (uint64, map[string]uint64, error) {
+	filter := bson.M{"short_url": shortURL}
+	if !includeBots {
+		filter["bots"] = false
+	}
+	dayRange := bson.M{}
+	if fromDay != "" {
+		dayRange["$gte"] = fromDay
+	}
+	if toDay != "" {
+		dayRange["$lte"] = toDay
+	}
+	if len(dayRange) > 0 {
+		filter["day"] = dayRange
+	}
+
+	cursor, err := visitorCollection.Find(ctx, filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	total := utils.NewHyperLogLog()
+	days := make(map[string]*utils.HyperLogLog)
+	for cursor.Next(ctx) {
+		var stored visitorSketch
+		if err := cursor.Decode(&stored); err != nil {
+			return 0, nil, err
+		}
+		sketch, err := utils.HyperLogLogFromBytes(stored.Registers)
+		if err != nil {
+			return 0, nil, err
+		}
+		total.Merge(sketch)
+		if day, ok := days[stored.Day]; ok {
+			day.Merge(sketch)
+		} else {
+			days[stored.Day] = sketch
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	daily := make(map[string]uint64, len(days))
+	for day, sketch := range days {
+		daily[day] = sketch.Count()
+	}
+	return total.Count(), daily, nil
+}
+
+// deleteExpiredVisitorSketches removes sketches for days before cutoff
+func deleteExpiredVisitorSketches(ctx context.Context, cutoff time.Time) error {
+	_, err := visitorCollection.DeleteMany(ctx, bson.M{
+		"day": bson.M{"$lt": cutoff.UTC().Format(dayLayout)},
+	})
+	return err
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// worker is a background goroutine that is stopped at shutdown
+type worker struct {
+	name     string
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var (
+	workersMu sync.Mutex
+	workers   []*worker
+)
+
+// startWorker runs fn in a new goroutine. fn must return soon after stop
+// is closed, having finished or flushed its work.
+func startWorker(name string, fn func(stop <-chan struct{})) {
+	w := &worker{name: name, stop: make(chan struct{}), done: make(chan struct{})}
+
+	workersMu.Lock()
+	workers = append(workers, w)
+	workersMu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		fn(w.stop)
+	}()
+}
+
+// WorkersRunning reports, by name, whether each background worker that was
+// started is still running
+func WorkersRunning() map[string]bool {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+
+	running := make(map[string]bool, len(workers))
+	for _, w := range workers {
+		select {
+		case <-w.done:
+			running[w.name] = false
+		default:
+			running[w.name] = true
+		}
+	}
+	return running
+}
+
+// StopWorkers asks every background worker to stop and waits until they
+// have flushed their work, or until ctx expires
+func StopWorkers(ctx context.Context) error {
+	workersMu.Lock()
+	stopping := append([]*worker(nil), workers...)
+	workersMu.Unlock()
+
+	for _, w := range stopping {
+		w.stopOnce.Do(func() { close(w.stop) })
+	}
+	for _, w := range stopping {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for the %s worker to stop", w.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+	"url-short-backned/cache"
+)
+
+// bucket is a token bucket as of its last update
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryLimiter keeps token buckets in this instance's memory
+type memoryLimiter struct {
+	mu      sync.Mutex
+	buckets *cache.LRU[string, bucket]
+}
+
+func newMemoryLimiter(size int) *memoryLimiter {
+	return &memoryLimiter{buckets: cache.New[string, bucket](size)}
+}
+
+// take refills the bucket of key, which holds up to limit tokens and fills
+// up from empty in period, then takes a token if there is one. It returns
+// whether a token was taken and the tokens left.
+func (l *memoryLimiter) take(key string, limit int, period time.Duration, now time.Time) (bool, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(limit)
+	b, ok := l.buckets.Get(key)
+	if !ok {
+		// Unknown or expired, which it only does once full again
+		b = bucket{tokens: capacity, updated: now}
+	}
+	elapsed := max(now.Sub(b.updated), 0)
+	b.tokens = min(capacity, b.tokens+capacity*elapsed.Seconds()/period.Seconds())
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	l.buckets.Add(key, b, period)
+	return allowed, b.tokens
+}
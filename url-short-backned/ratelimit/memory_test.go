@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryTake(t *testing.T) {
+	limiter := newMemoryLimiter(10)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A full bucket of 3 hands out 3 tokens, then refuses
+	for left := 2; left >= 0; left-- {
+		if taken, tokens := limiter.take("key", 3, 3*time.Second, now); !taken || tokens != float64(left) {
+			t.Fatalf("take = %v, %v; want true, %d", taken, tokens, left)
+		}
+	}
+	if taken, tokens := limiter.take("key", 3, 3*time.Second, now); taken || tokens != 0 {
+		t.Fatalf("take on an empty bucket = %v, %v; want false, 0", taken, tokens)
+	}
+
+	// It refills at capacity per period, in fractions of a token
+	if taken, tokens := limiter.take("key", 3, 3*time.Second, now.Add(500*time.Millisecond)); taken || tokens != 0.5 {
+		t.Fatalf("take after 0.5s = %v, %v; want false, 0.5", taken, tokens)
+	}
+	if taken, tokens := limiter.take("key", 3, 3*time.Second, now.Add(1500*time.Millisecond)); !taken || tokens != 0.5 {
+		t.Fatalf("take after 1.5s = %v, %v; want true, 0.5", taken, tokens)
+	}
+
+	// It never holds more than its capacity
+	if taken, tokens := limiter.take("key", 3, 3*time.Second, now.Add(time.Hour)); !taken || tokens != 2 {
+		t.Fatalf("take after an hour = %v, %v; want true, 2", taken, tokens)
+	}
+
+	// A clock going backwards doesn't drain it
+	if taken, tokens := limiter.take("key", 3, 3*time.Second, now); !taken || tokens != 1 {
+		t.Fatalf("take back in time = %v, %v; want true, 1", taken, tokens)
+	}
+
+	// Buckets are independent
+	if taken, tokens := limiter.take("other", 3, 3*time.Second, now); !taken || tokens != 2 {
+		t.Errorf("take on another bucket = %v, %v; want true, 2", taken, tokens)
+	}
+}
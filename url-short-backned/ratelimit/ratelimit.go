@@ -0,0 +1,172 @@
+// Package ratelimit limits how fast clients may create links, with a token
+// bucket per client IP, authenticated user or API key. Buckets are kept in
+// memory or in the shared cache, so every instance sees the same limits.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"url-short-backned/config"
+	"url-short-backned/metrics"
+	"url-short-backned/sharedcache"
+	"url-short-backned/utils"
+)
+
+// APIKeyHeader is the request header carrying an API key
+const APIKeyHeader = "X-API-Key"
+
+// Client classes, each with its own limit
+const (
+	classIP     = "ip"
+	classUser   = "user"
+	classAPIKey = "api_key"
+)
+
+// Buckets kept in memory per instance. Idle ones expire once full again,
+// and the least recently used are evicted past this.
+const memoryBuckets = 100000
+
+var (
+	settings *config.Config
+	local    *memoryLimiter
+
+	rateLimited = metrics.NewCounterVec("urlshortener_rate_limited_total",
+		"Requests rejected by the rate limiter, by client class (ip, user or api_key).", "class")
+)
+
+// Init configures the rate limiter. It must be called after
+// sharedcache.Init and before the routes are served.
+func Init(cfg *config.Config) {
+	settings = cfg
+	local = newMemoryLimiter(memoryBuckets)
+}
+
+// Middleware rejects requests beyond the limit of their client with 429
+// Too Many Requests. Routes sharing a scope share their clients' buckets.
+// Every response carries RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, and rejections a Retry-After header. Requests
+// with an unknown API key are rejected with 401 Unauthorized.
+func Middleware(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, id, ok := identify(r)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			http.Error(w, `{"error":"Invalid API key"}`, http.StatusUnauthorized)
+			return
+		}
+
+		limit := limitOf(class)
+		if limit == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		period := settings.RateLimitPeriod
+		allowed, tokens := take(r.Context(), scope+":"+class+":"+id, limit, period)
+
+		// Time for one token, and for the bucket to fill up again
+		perToken := period / time.Duration(limit)
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		h.Set("RateLimit-Reset", seconds(time.Duration((float64(limit)-tokens)*float64(perToken))))
+		h.Set("RateLimit-Policy", strconv.Itoa(limit)+";w="+seconds(period))
+
+		if !allowed {
+			rateLimited.Inc(class)
+			h.Set("Retry-After", seconds(time.Duration((1-tokens)*float64(perToken))))
+			h.Set("Content-Type", "application/json")
+			http.Error(w, `{"error":"Too many requests, slow down"}`, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Owner returns who the request is authenticated as: a known API key or a
+// user passed by a trusted proxy. It returns "" for anonymous requests and
+// unknown API keys.
+func Owner(r *http.Request) string {
+	class, id, ok := identify(r)
+	if !ok || class == classIP {
+		return ""
+	}
+	return class + ":" + id
+}
+
+// identify returns the class and ID of the client that sent the request.
+// It reports false for an unknown API key.
+func identify(r *http.Request) (class, id string, ok bool) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		if !validAPIKey(key) {
+			return "", "", false
+		}
+		// Keys are hashed so they never end up in the shared cache
+		sum := sha256.Sum256([]byte(key))
+		return classAPIKey, hex.EncodeToString(sum[:8]), true
+	}
+
+	if settings.UserHeader != "" {
+		if user := r.Header.Get(settings.UserHeader); user != "" && fromTrustedProxy(r) {
+			return classUser, user, true
+		}
+	}
+
+	return classIP, utils.ClientIP(r, settings.TrustedProxyPrefixes), true
+}
+
+func validAPIKey(key string) bool {
+	valid := false
+	for _, known := range settings.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// fromTrustedProxy reports whether the request was sent by a trusted
+// proxy, rather than directly by the client
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return utils.IsTrustedProxy(host, settings.TrustedProxyPrefixes)
+}
+
+func limitOf(class string) int {
+	switch class {
+	case classAPIKey:
+		return settings.RateLimitAPIKey
+	case classUser:
+		return settings.RateLimitUser
+	default:
+		return settings.RateLimitIP
+	}
+}
+
+// take takes a token from the bucket of key. Buckets in the shared cache
+// fall back to this instance's while it is unreachable, so an outage
+// loosens the limits rather than rejecting everyone.
+func take(ctx context.Context, key string, limit int, period time.Duration) (bool, float64) {
+	if settings.RateLimitBackend == "shared" {
+		allowed, tokens, err := sharedcache.TakeToken(ctx, "ratelimit:"+key, limit, period)
+		if err == nil {
+			return allowed, tokens
+		}
+	}
+	return local.take(key, limit, period, time.Now())
+}
+
+// seconds formats d as whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(max(d, 0).Seconds())))
+}
@@ -0,0 +1,142 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+	"url-short-backned/config"
+)
+
+// setup initialises the rate limiter with in-memory buckets, the default
+// settings as changed by configure, and a trusted proxy at 10.0.0.1
+func setup(t *testing.T, configure func(*config.Config)) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.RateLimitPeriod = time.Minute
+	cfg.RateLimitIP = 2
+	cfg.RateLimitUser = 4
+	cfg.RateLimitAPIKey = 6
+	cfg.UserHeader = "X-User"
+	cfg.APIKeys = []string{"secret-key"}
+	cfg.TrustedProxyPrefixes = []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}
+	if configure != nil {
+		configure(cfg)
+	}
+	Init(cfg)
+}
+
+// serve sends a request through a rate-limited handler of scope, from
+// remoteAddr and with the given headers
+func serve(scope, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	handler := Middleware(scope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", nil)
+	req.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddlewareHeaders(t *testing.T) {
+	setup(t, nil)
+
+	// Two tokens a minute, so one every 30s
+	tests := []struct {
+		code       int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+	for i, tt := range tests {
+		w := serve("create", "192.0.2.1:1234", nil)
+		h := w.Header()
+		if w.Code != tt.code {
+			t.Errorf("request %d: status %d; want %d", i, w.Code, tt.code)
+		}
+		if got := h.Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: RateLimit-Limit %q; want 2", i, got)
+		}
+		if got := h.Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("request %d: RateLimit-Policy %q; want 2;w=60", i, got)
+		}
+		if got := h.Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining %q; want %s", i, got, tt.remaining)
+		}
+		if got := h.Get("RateLimit-Reset"); got != tt.reset {
+			t.Errorf("request %d: RateLimit-Reset %q; want %s", i, got, tt.reset)
+		}
+		if got := h.Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("request %d: Retry-After %q; want %q", i, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestMiddlewareClasses(t *testing.T) {
+	setup(t, nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		limit      string
+	}{
+		{"ip", "192.0.2.1:1234", nil, "2"},
+		{"api key", "192.0.2.1:1234", map[string]string{APIKeyHeader: "secret-key"}, "6"},
+		{"user via proxy", "10.0.0.1:1234", map[string]string{"X-User": "alice"}, "4"},
+		// Only a trusted proxy may say who the user is
+		{"user without proxy", "192.0.2.1:1234", map[string]string{"X-User": "alice"}, "2"},
+	}
+	for _, tt := range tests {
+		w := serve("create", tt.remoteAddr, tt.headers)
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != tt.limit {
+			t.Errorf("%s: status %d, limit %q; want 200, %s", tt.name, w.Code, w.Header().Get("RateLimit-Limit"), tt.limit)
+		}
+	}
+
+	if w := serve("create", "192.0.2.1:1234", map[string]string{APIKeyHeader: "wrong-key"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown API key: status %d; want 401", w.Code)
+	}
+}
+
+func TestMiddlewareBuckets(t *testing.T) {
+	setup(t, nil)
+
+	for i := 0; i < 2; i++ {
+		serve("create", "192.0.2.1:1234", nil)
+	}
+	if w := serve("create", "192.0.2.1:1234", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d once the bucket is empty; want 429", w.Code)
+	}
+
+	// Other clients and other scopes have buckets of their own
+	if w := serve("create", "192.0.2.2:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d; want 200", w.Code)
+	}
+	if w := serve("report", "192.0.2.1:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("another scope: status %d; want 200", w.Code)
+	}
+	// Clients behind a trusted proxy are told apart by X-Forwarded-For
+	headers := map[string]string{"X-Forwarded-For": "192.0.2.1"}
+	if w := serve("create", "10.0.0.1:1234", headers); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same client via proxy: status %d; want 429", w.Code)
+	}
+}
+
+func TestMiddlewareUnlimited(t *testing.T) {
+	setup(t, func(cfg *config.Config) { cfg.RateLimitIP = 0 })
+
+	for i := 0; i < 5; i++ {
+		w := serve("create", "192.0.2.1:1234", nil)
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("status %d, limit %q without a limit; want 200 and no headers", w.Code, w.Header().Get("RateLimit-Limit"))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"net/http"
+	"url-short-backned/controllers"
+	"url-short-backned/metrics"
+	"url-short-backned/utils"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// FastRedirects serves GET requests for generated short codes
+// straight from controllers.RedirectURL, skipping the router and its
+// middleware. Redirects are most of the traffic, and route matching and
+// tracing cost more than the cached lookup itself. They are still counted
+// under the "redirect" route, but get no span of their own. An incoming
+// trace context is still extracted, so the spans of lookups that reach the
+// stores join the caller's trace. Every other request goes to next.
+func FastRedirects(next http.Handler) http.Handler {
+	redirect := metrics.Route("redirect", controllers.RedirectURL)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && isShortCodePath(r.URL.Path) {
+			redirect.ServeHTTP(w, withTraceContext(r))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTraceContext returns r with the trace context of its headers, as
+// otelmux would extract it. Requests without one are returned as they
+// are, to keep untraced redirects free of the extraction's allocations.
+func withTraceContext(r *http.Request) *http.Request {
+	if r.Header.Get("Traceparent") == "" && r.Header.Get("Baggage") == "" {
+		return r
+	}
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return r.WithContext(ctx)
+}
+
+// isShortCodePath reports whether path is a slash followed by a generated
+// short code. Fixed routes such as /healthz are shorter, so never match.
+func isShortCodePath(path string) bool {
+	if len(path) != 1+utils.ShortURLLength || path[0] != '/' {
+		return false
+	}
+	for i := 1; i < len(path); i++ {
+		c := path[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
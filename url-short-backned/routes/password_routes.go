@@ -3,13 +3,14 @@ package routes
 import (
 	"net/http"
 	"url-short-backned/controllers"
+	"url-short-backned/ratelimit"
 
 	"github.com/gorilla/mux"
 )
 
 func InitializePasswordRoutes(router *mux.Router) {
-	router.HandleFunc("/create", controllers.CreateProtectedURL).Methods("POST")
-	router.HandleFunc("/{shortURL}", controllers.RedirectProtectedURL).Methods("POST")
+	router.Handle("/create", ratelimit.Middleware("create", http.HandlerFunc(controllers.CreateProtectedURL))).Methods("POST").Name("create_protected")
+	router.HandleFunc("/{shortURL}", controllers.RedirectProtectedURL).Methods("POST").Name("protected_redirect")
 
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Route not foundd"}`, http.StatusNotFound)
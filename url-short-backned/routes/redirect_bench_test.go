@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"url-short-backned/config"
+	"url-short-backned/controllers"
+	"url-short-backned/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	benchShortURL    = "aB3dE5gH"
+	benchOriginalURL = "https://example.com/some/long/path?with=query"
+)
+
+// setupRedirectBench initialises the models against a MongoDB client that
+// is never reached, with one link cached, so only the redirect path is
+// measured
+func setupRedirectBench(b *testing.B) *config.Config {
+	b.Helper()
+
+	cfg := config.Default()
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Disconnect(context.Background()) })
+	config.Client = client
+
+	models.Init(cfg)
+	controllers.Init(cfg)
+	models.PrimeURLCache(benchShortURL, benchOriginalURL)
+	return cfg
+}
+
+func benchmarkRedirect(b *testing.B, handler http.Handler) {
+	req := httptest.NewRequest(http.MethodGet, "/"+benchShortURL, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			b.Fatalf("status = %d, want %d", w.Code, http.StatusFound)
+		}
+	}
+}
+
+// BenchmarkRedirectRouter serves a cached redirect through the router and
+// its middleware, the path FastRedirects skips
+func BenchmarkRedirectRouter(b *testing.B) {
+	cfg := setupRedirectBench(b)
+	benchmarkRedirect(b, SetupRoutes(cfg))
+}
+
+// BenchmarkRedirectFastPath serves a cached redirect through FastRedirects
+func BenchmarkRedirectFastPath(b *testing.B) {
+	cfg := setupRedirectBench(b)
+	benchmarkRedirect(b, FastRedirects(SetupRoutes(cfg)))
+}
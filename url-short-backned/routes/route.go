@@ -1,16 +1,56 @@
 package routes
 
 import (
+	"net/http"
+	"url-short-backned/config"
 	"url-short-backned/controllers"
+	"url-short-backned/metrics"
+	"url-short-backned/ratelimit"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
-func SetupRoutes() *mux.Router {
+func SetupRoutes(cfg *config.Config) *mux.Router {
 	router := mux.NewRouter()
 
+	// Trace and record metrics for every route. Probes are frequent and
+	// uninteresting, so they are left out of traces.
+	router.Use(otelmux.Middleware(cfg.ServiceName, otelmux.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/healthz" && r.URL.Path != "/readyz"
+	})))
+	router.Use(metrics.Middleware)
+
 	// Register routes
-	router.HandleFunc("/api/shorten", controllers.ShortenURL).Methods("POST")
-	router.HandleFunc("/{shortURL}", controllers.RedirectURL).Methods("GET")
+	router.HandleFunc("/healthz", controllers.Healthz).Methods("GET").Name("healthz")
+	router.HandleFunc("/readyz", controllers.Readyz).Methods("GET").Name("readyz")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET").Name("metrics")
+	router.Handle("/api/shorten", ratelimit.Middleware("create", http.HandlerFunc(controllers.ShortenURL))).Methods("POST").Name("shorten")
+	router.HandleFunc("/api/urls/{shortURL}/stats", controllers.GetURLStats).Methods("GET")
+	router.Handle("/api/urls/{shortURL}/export/clicks", controllers.RequireOwner(http.HandlerFunc(controllers.ExportClicks))).Methods("GET")
+	router.Handle("/api/urls/{shortURL}/export/stats", controllers.RequireOwner(http.HandlerFunc(controllers.ExportStats))).Methods("GET")
+	router.HandleFunc("/api/export/clicks", controllers.ExportOwnerClicks).Methods("GET")
+	router.HandleFunc("/api/export/stats", controllers.ExportOwnerStats).Methods("GET")
+	router.HandleFunc("/api/account/data", controllers.ExportOwnerData).Methods("GET")
+	router.HandleFunc("/api/account/data", controllers.EraseOwnerData).Methods("DELETE")
+	router.HandleFunc("/api/account/privacy", controllers.GetOwnerPrivacy).Methods("GET")
+	router.HandleFunc("/api/account/privacy", controllers.SetOwnerPrivacy).Methods("PUT")
+	router.HandleFunc("/api/urls/{shortURL}/live", controllers.StreamURLClicks).Methods("GET")
+	router.Handle("/api/live", controllers.RequireAdmin(http.HandlerFunc(controllers.StreamAllClicks))).Methods("GET")
+	router.Handle("/api/report", ratelimit.Middleware("report", http.HandlerFunc(controllers.ReportURL))).Methods("POST").Name("report")
+
+	// Moderation and data requests, for admins only
+	admin := router.PathPrefix("/api/admin").Subrouter()
+	admin.Use(controllers.RequireAdmin)
+	admin.HandleFunc("/reports", controllers.ListReportedURLs).Methods("GET")
+	admin.HandleFunc("/urls/{shortURL}/{action:disable|ban|restore}", controllers.ModerateURL).Methods("POST")
+	admin.HandleFunc("/visitors", controllers.ExportVisitorData).Methods("GET")
+	admin.HandleFunc("/visitors", controllers.EraseVisitorData).Methods("DELETE")
+	admin.HandleFunc("/owners/{owner}/data", controllers.ExportOwnerData).Methods("GET")
+	admin.HandleFunc("/owners/{owner}/data", controllers.EraseOwnerData).Methods("DELETE")
+	admin.HandleFunc("/owners/{owner}/privacy", controllers.GetOwnerPrivacy).Methods("GET")
+	admin.HandleFunc("/owners/{owner}/privacy", controllers.SetOwnerPrivacy).Methods("PUT")
+
+	router.HandleFunc("/{shortURL}", controllers.RedirectURL).Methods("GET").Name("redirect")
 
 	return router
 }
@@ -0,0 +1,207 @@
+// Package sharedcache is the cache tier shared by every instance through a
+// Redis-protocol server. It holds link lookups and rate-limit buckets and
+// broadcasts invalidations over pub/sub. It is optional: when no server is
+// configured every call is a no-op miss, and errors are meant to be
+// treated as misses rather than failures.
+package sharedcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+	"url-short-backned/config"
+	"url-short-backned/metrics"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	client *redis.Client
+	prefix string
+
+	sharedCacheErrors = metrics.NewCounterVec("urlshortener_shared_cache_errors_total",
+		"Shared cache operations that failed, by operation.", "operation")
+)
+
+// takeToken refills a token bucket of ARGV[1] tokens that fills up in
+// ARGV[2] milliseconds, then takes a token if there is one. It returns
+// whether a token was taken and the tokens left, as a string since Lua
+// numbers are truncated to integers on the way out. The server's clock is
+// used so every instance agrees on it.
+var takeToken = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = time[1] * 1000 + math.floor(time[2] / 1000)
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * capacity / period)
+
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], period)
+return {taken, tostring(tokens)}
+`)
+
+// Init connects to the shared cache when cfg.RedisURL is set. An
+// unreachable server only logs a warning, since instances still work from
+// their own cache and MongoDB.
+func Init(ctx context.Context, cfg *config.Config) error {
+	if cfg.RedisURL == "" {
+		return nil
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return fmt.Errorf("invalid redis_url: %v", err)
+	}
+	opts.PoolSize = cfg.RedisPoolSize
+	opts.DialTimeout = cfg.RedisTimeout
+	opts.ReadTimeout = cfg.RedisTimeout
+	opts.WriteTimeout = cfg.RedisTimeout
+
+	client = redis.NewClient(opts)
+	prefix = cfg.RedisKeyPrefix
+
+	pingCtx, cancel := context.WithTimeout(ctx, cfg.RedisTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		slog.Warn("Shared cache is not reachable, continuing without it until it is", "addr", opts.Addr, "error", err)
+	} else {
+		slog.Info("Connected to shared cache", "addr", opts.Addr)
+	}
+	return nil
+}
+
+// Enabled reports whether a shared cache is configured
+func Enabled() bool {
+	return client != nil
+}
+
+// Close releases the shared cache connections, disabling it. It must only
+// be called once nothing uses the shared cache any more.
+func Close() {
+	if client == nil {
+		return
+	}
+	if err := client.Close(); err != nil {
+		slog.Error("Error closing shared cache", "error", err)
+	}
+	client = nil
+}
+
+// Get returns the value stored under key, and whether there was one
+func Get(ctx context.Context, key string) (string, bool, error) {
+	if client == nil {
+		return "", false, nil
+	}
+	value, err := client.Get(ctx, prefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, failed("get", err)
+	}
+	return value, true, nil
+}
+
+// Set stores value under key until ttl passes
+func Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if client == nil {
+		return nil
+	}
+	return failed("set", client.Set(ctx, prefix+key, value, ttl).Err())
+}
+
+// Delete removes key
+func Delete(ctx context.Context, key string) error {
+	if client == nil {
+		return nil
+	}
+	return failed("delete", client.Del(ctx, prefix+key).Err())
+}
+
+// TakeToken takes a token from the bucket stored under key, which holds up
+// to capacity tokens and fills up from empty in period. It returns whether
+// a token was taken and the tokens left.
+func TakeToken(ctx context.Context, key string, capacity int, period time.Duration) (bool, float64, error) {
+	if client == nil {
+		return false, 0, errors.New("shared cache is not configured")
+	}
+	result, err := takeToken.Run(ctx, client, []string{prefix + key}, capacity, period.Milliseconds()).Slice()
+	if err != nil {
+		return false, 0, failed("take_token", err)
+	}
+	if len(result) != 2 {
+		return false, 0, failed("take_token", fmt.Errorf("unexpected reply %v", result))
+	}
+	taken, _ := result[0].(int64)
+	left, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return false, 0, failed("take_token", err)
+	}
+	return taken == 1, tokens, nil
+}
+
+// Publish broadcasts message to every subscriber of channel, this
+// instance's included
+func Publish(ctx context.Context, channel, message string) error {
+	if client == nil {
+		return nil
+	}
+	return failed("publish", client.Publish(ctx, prefix+channel, message).Err())
+}
+
+// Subscription receives the messages published on a channel
+type Subscription struct {
+	// C delivers each message. The subscription reconnects by itself
+	// after connection failures, missing what was published meanwhile.
+	C <-chan string
+
+	pubsub *redis.PubSub
+	done   chan struct{}
+}
+
+// Subscribe starts receiving the messages published on channel. It must
+// only be called when Enabled.
+func Subscribe(ctx context.Context, channel string) *Subscription {
+	sub := &Subscription{pubsub: client.Subscribe(ctx, prefix+channel), done: make(chan struct{})}
+	messages := make(chan string)
+	sub.C = messages
+
+	go func() {
+		defer close(messages)
+		for msg := range sub.pubsub.Channel() {
+			select {
+			case messages <- msg.Payload:
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() error {
+	close(s.done)
+	return s.pubsub.Close()
+}
+
+// failed counts err against operation and returns it
+func failed(operation string, err error) error {
+	if err != nil {
+		sharedCacheErrors.Inc(operation)
+	}
+	return err
+}
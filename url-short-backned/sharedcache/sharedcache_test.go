@@ -0,0 +1,159 @@
+package sharedcache
+
+import (
+	"context"
+	"testing"
+	"time"
+	"url-short-backned/config"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// startMiniredis points the package at a fresh in-process server for the
+// duration of the test
+func startMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+
+	cfg := config.Default()
+	cfg.RedisURL = "redis://" + server.Addr()
+	cfg.RedisKeyPrefix = "test:"
+	if err := Init(context.Background(), cfg); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(Close)
+	return server
+}
+
+func TestDisabled(t *testing.T) {
+	ctx := context.Background()
+	if Enabled() {
+		t.Fatal("Enabled without a server")
+	}
+	if _, ok, err := Get(ctx, "key"); ok || err != nil {
+		t.Errorf("Get = %v, %v; want a quiet miss", ok, err)
+	}
+	if err := Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Errorf("Set: %v", err)
+	}
+	if _, _, err := TakeToken(ctx, "bucket", 1, time.Second); err == nil {
+		t.Error("TakeToken succeeded without a server")
+	}
+}
+
+func TestGetSetDelete(t *testing.T) {
+	server := startMiniredis(t)
+	ctx := context.Background()
+
+	if _, ok, err := Get(ctx, "key"); ok || err != nil {
+		t.Fatalf("Get before Set = %v, %v; want a miss", ok, err)
+	}
+
+	if err := Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	value, ok, err := Get(ctx, "key")
+	if !ok || err != nil || value != "value" {
+		t.Fatalf("Get = %q, %v, %v; want value", value, ok, err)
+	}
+	if !server.Exists("test:key") {
+		t.Error("key stored without the configured prefix")
+	}
+
+	server.FastForward(time.Minute)
+	if _, ok, _ := Get(ctx, "key"); ok {
+		t.Error("Get found the key after its TTL")
+	}
+
+	if err := Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := Delete(ctx, "key"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok, _ := Get(ctx, "key"); ok {
+		t.Error("Get found the key after Delete")
+	}
+}
+
+func TestGetError(t *testing.T) {
+	server := startMiniredis(t)
+	server.SetError("server is down")
+
+	if _, ok, err := Get(context.Background(), "key"); ok || err == nil {
+		t.Errorf("Get = %v, %v; want an error", ok, err)
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	server := startMiniredis(t)
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	server.SetTime(now)
+
+	// A full bucket of 3 hands out 3 tokens, then refuses
+	for i := 2; i >= 0; i-- {
+		taken, left, err := TakeToken(ctx, "bucket", 3, 3*time.Second)
+		if err != nil {
+			t.Fatalf("TakeToken: %v", err)
+		}
+		if !taken || left != float64(i) {
+			t.Fatalf("TakeToken = %v, %v; want true, %d", taken, left, i)
+		}
+	}
+	taken, left, err := TakeToken(ctx, "bucket", 3, 3*time.Second)
+	if err != nil || taken || left != 0 {
+		t.Fatalf("TakeToken on an empty bucket = %v, %v, %v; want false, 0", taken, left, err)
+	}
+
+	// It refills at capacity per period, in fractions of a token
+	server.SetTime(now.Add(1500 * time.Millisecond))
+	taken, left, err = TakeToken(ctx, "bucket", 3, 3*time.Second)
+	if err != nil || !taken || left != 0.5 {
+		t.Fatalf("TakeToken after 1.5s = %v, %v, %v; want true, 0.5", taken, left, err)
+	}
+
+	// Buckets are independent, and expire once they would be full again
+	if taken, _, _ := TakeToken(ctx, "other", 3, 3*time.Second); !taken {
+		t.Error("TakeToken on another bucket was refused")
+	}
+	if ttl := server.TTL("test:bucket"); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("bucket TTL = %v; want at most the period", ttl)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	server := startMiniredis(t)
+	ctx := context.Background()
+
+	sub := Subscribe(ctx, "channel")
+	defer sub.Close()
+	// Wait for the subscription to be registered before publishing
+	for deadline := time.Now().Add(2 * time.Second); server.PubSubNumSub("test:channel")["test:channel"] == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription was never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := Publish(ctx, "channel", "message"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := Publish(ctx, "other", "ignored"); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case message := <-sub.C:
+		if message != "message" {
+			t.Errorf("received %q; want message", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	select {
+	case message := <-sub.C:
+		t.Errorf("received %q from another channel", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,368 @@
+package urlcheck
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"url-short-backned/metrics"
+)
+
+// Threat feed formats
+const (
+	// One domain per line, or hosts file lines such as "0.0.0.0 evil.example".
+	// Subdomains of a listed domain are blocked too.
+	formatDomains = "domains"
+
+	// URLhaus-style CSV, blocking the exact URL in each row
+	formatURLhaus = "urlhaus"
+
+	// Safe-Browsing-style hex SHA-256 prefixes of URL expressions, one per
+	// line
+	formatHashes = "hashes"
+)
+
+// Hosts file entries that are never threats
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "0.0.0.0": true,
+}
+
+// feed is one loaded threat feed file
+type feed struct {
+	path    string
+	name    string
+	format  string
+	modTime time.Time
+	size    int64
+
+	domains map[string]struct{}
+	urls    map[string]struct{}
+	// Hash prefixes, by length in bytes
+	prefixes map[int]map[string]struct{}
+}
+
+var (
+	feedsMu     sync.Mutex // Serialises reloads
+	loadedFeeds atomic.Pointer[[]*feed]
+)
+
+func init() {
+	metrics.NewGaugeFunc("urlshortener_threat_feed_entries",
+		"Domains, URLs and hash prefixes loaded from threat feeds.",
+		func() float64 {
+			total := 0
+			for _, f := range currentFeeds() {
+				total += f.entries()
+			}
+			return float64(total)
+		})
+}
+
+func currentFeeds() []*feed {
+	if feeds := loadedFeeds.Load(); feeds != nil {
+		return *feeds
+	}
+	return nil
+}
+
+// ReloadFeeds reads the threat feeds again if their files changed since
+// they were last loaded. A feed that fails to load keeps its previous
+// entries. It reports whether any feed changed.
+func ReloadFeeds() (bool, error) {
+	feedsMu.Lock()
+	defer feedsMu.Unlock()
+
+	previous := make(map[string]*feed)
+	for _, f := range currentFeeds() {
+		previous[f.path] = f
+	}
+
+	changed := false
+	var errs []error
+	feeds := make([]*feed, 0, len(settings.ThreatFeeds))
+	for _, spec := range settings.ThreatFeeds {
+		format, path := parseFeedSpec(spec)
+		old := previous[path]
+
+		info, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, err)
+			if old != nil {
+				feeds = append(feeds, old)
+			}
+			continue
+		}
+		if old != nil && old.modTime.Equal(info.ModTime()) && old.size == info.Size() {
+			feeds = append(feeds, old)
+			continue
+		}
+
+		loaded, err := loadFeed(path, format)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("threat feed %s: %v", path, err))
+			if old != nil {
+				feeds = append(feeds, old)
+			}
+			continue
+		}
+		loaded.modTime, loaded.size = info.ModTime(), info.Size()
+		feeds = append(feeds, loaded)
+		changed = true
+	}
+
+	loadedFeeds.Store(&feeds)
+	return changed, errors.Join(errs...)
+}
+
+// Blocked reports whether a destination is listed in a threat feed, and
+// in which
+func Blocked(rawURL string) (string, bool) {
+	feeds := currentFeeds()
+	if len(feeds) == 0 {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return "", false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	canonical := canonicalURL(u)
+
+	var expressions [][sha256.Size]byte
+	for _, f := range feeds {
+		switch f.format {
+		case formatDomains:
+			for domain := host; domain != ""; domain = parentDomain(domain) {
+				if _, ok := f.domains[domain]; ok {
+					return f.name, true
+				}
+			}
+		case formatURLhaus:
+			if _, ok := f.urls[canonical]; ok {
+				return f.name, true
+			}
+		case formatHashes:
+			if expressions == nil {
+				expressions = hashExpressions(host, u)
+			}
+			for _, sum := range expressions {
+				for length, prefixes := range f.prefixes {
+					if _, ok := prefixes[string(sum[:length])]; ok {
+						return f.name, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// parseFeedSpec splits a feed setting into its format and path. The format
+// is given as a "format:" prefix or guessed from the file extension.
+func parseFeedSpec(spec string) (string, string) {
+	if format, path, ok := strings.Cut(spec, ":"); ok {
+		switch format {
+		case formatDomains, formatURLhaus, formatHashes:
+			return format, path
+		}
+	}
+	switch strings.ToLower(filepath.Ext(spec)) {
+	case ".csv":
+		return formatURLhaus, spec
+	case ".hashes":
+		return formatHashes, spec
+	default:
+		return formatDomains, spec
+	}
+}
+
+func loadFeed(path, format string) (*feed, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	f := &feed{path: path, name: filepath.Base(path), format: format}
+	switch format {
+	case formatURLhaus:
+		err = f.readURLhaus(file)
+	case formatHashes:
+		err = f.readHashes(file)
+	default:
+		err = f.readDomains(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *feed) readDomains(r io.Reader) error {
+	f.domains = make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if _, err := netip.ParseAddr(name); err == nil && len(fields) > 1 {
+			name = fields[1] // Hosts file line
+		}
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if ascii, err := hostProfile.ToASCII(name); err == nil {
+			name = strings.ToLower(ascii)
+		}
+		if name == "" || hostsFileNames[name] {
+			continue
+		}
+		f.domains[name] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func (f *feed) readURLhaus(r io.Reader) error {
+	f.urls = make(map[string]struct{})
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The URL column moves between exports, so take the first URL
+		for _, field := range record {
+			lower := strings.ToLower(field)
+			if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+				continue
+			}
+			if u, err := url.Parse(strings.TrimSpace(field)); err == nil && u.Host != "" {
+				f.urls[canonicalURL(u)] = struct{}{}
+			}
+			break
+		}
+	}
+}
+
+func (f *feed) readHashes(r io.Reader) error {
+	f.prefixes = make(map[int]map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		prefix, err := hex.DecodeString(line)
+		if err != nil || len(prefix) < 4 || len(prefix) > sha256.Size {
+			return fmt.Errorf("invalid hash prefix %q", line)
+		}
+		if f.prefixes[len(prefix)] == nil {
+			f.prefixes[len(prefix)] = make(map[string]struct{})
+		}
+		f.prefixes[len(prefix)][string(prefix)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func (f *feed) entries() int {
+	total := len(f.domains) + len(f.urls)
+	for _, prefixes := range f.prefixes {
+		total += len(prefixes)
+	}
+	return total
+}
+
+// canonicalURL puts a URL in the form feed entries are compared in:
+// lower-case scheme and host, no default port, user info or fragment, and
+// at least a "/" path
+func canonicalURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPort(scheme) {
+		host += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return scheme + "://" + host + path
+}
+
+// hashExpressions returns the SHA-256 hashes of the host suffix and path
+// prefix expressions of a URL, as Safe Browsing looks them up
+func hashExpressions(host string, u *url.URL) [][sha256.Size]byte {
+	hosts := []string{host}
+	if _, err := netip.ParseAddr(host); err != nil {
+		// The last five components, then dropping leading ones down to two
+		labels := strings.Split(host, ".")
+		start := max(len(labels)-5, 1)
+		for i := start; i <= len(labels)-2; i++ {
+			hosts = append(hosts, strings.Join(labels[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	paths := []string{path}
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	// "/" and up to three leading directories
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	prefix := "/"
+	for i := 0; i < 4; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+		if i >= len(segments)-1 {
+			break
+		}
+		prefix += segments[i] + "/"
+	}
+
+	sums := make([][sha256.Size]byte, 0, len(hosts)*len(paths))
+	for _, h := range hosts {
+		for _, p := range paths {
+			sums = append(sums, sha256.Sum256([]byte(h+p)))
+		}
+	}
+	return sums
+}
+
+// parentDomain strips the first label of a domain, returning "" for a
+// top-level one
+func parentDomain(domain string) string {
+	_, parent, ok := strings.Cut(domain, ".")
+	if !ok {
+		return ""
+	}
+	return parent
+}
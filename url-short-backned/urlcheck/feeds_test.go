@@ -0,0 +1,170 @@
+package urlcheck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"url-short-backned/config"
+)
+
+// writeFeed writes a feed file into dir and returns its path
+func writeFeed(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// hashPrefix returns the hex SHA-256 prefix of an expression, as listed in
+// a hashes feed
+func hashPrefix(expression string) string {
+	sum := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestBlocked(t *testing.T) {
+	dir := t.TempDir()
+	domains := writeFeed(t, dir, "domains.txt", `# Malware domains
+evil.example
+0.0.0.0 tracker.example # hosts file line
+127.0.0.1 localhost
+XN--BCHER-KVA.example.
+`)
+	urlhaus := writeFeed(t, dir, "urlhaus.csv", `# id,dateadded,url,url_status
+"1","2024-01-01 00:00:00","http://bad.example/payload.exe","online"
+"2","2024-01-01 00:00:00","https://bad.example:8443/x?y=1","online"
+`)
+	hashes := writeFeed(t, dir, "phish.hashes", "# Phishing\n"+
+		hashPrefix("phish.example/login/")+"\n"+
+		hashPrefix("203.0.113.7/")+"\n")
+	setup(t, func(cfg *config.Config) {
+		cfg.ThreatFeeds = []string{domains, urlhaus, "hashes:" + hashes}
+	})
+
+	tests := []struct {
+		url  string
+		feed string
+	}{
+		{"https://evil.example/", "domains.txt"},
+		{"https://deep.sub.EVIL.example./path", "domains.txt"},
+		{"http://tracker.example/pixel.gif", "domains.txt"},
+		{"https://xn--bcher-kva.example/", "domains.txt"},
+		{"https://notevil.example/", ""},
+		{"https://evil.example.com/", ""},
+		{"http://localhost/", ""},
+
+		// URLhaus entries match the exact URL, in canonical form
+		{"http://BAD.example:80/payload.exe", "urlhaus.csv"},
+		{"https://bad.example:8443/x?y=1", "urlhaus.csv"},
+		{"http://bad.example/payload.exe#top", "urlhaus.csv"},
+		{"http://bad.example/other.exe", ""},
+		{"https://bad.example/payload.exe", ""},
+
+		// Hashes match host suffix and path prefix expressions
+		{"https://phish.example/login/", "phish.hashes"},
+		{"https://www.phish.example/login/account?next=1", "phish.hashes"},
+		{"https://a.b.phish.example/login/step/2", "phish.hashes"},
+		{"https://phish.example/logout/", ""},
+		{"https://phish.example/", ""},
+		{"https://203.0.113.7/any/path", "phish.hashes"},
+		{"https://203.0.113.8/", ""},
+	}
+	for _, tt := range tests {
+		feed, blocked := Blocked(tt.url)
+		if blocked != (tt.feed != "") || feed != tt.feed {
+			t.Errorf("Blocked(%q) = %q, %v; want %q", tt.url, feed, blocked, tt.feed)
+		}
+	}
+}
+
+func TestHashExpressions(t *testing.T) {
+	// The examples of the Safe Browsing v4 documentation
+	tests := []struct {
+		url         string
+		expressions []string
+	}{
+		{"http://a.b.c/1/2.html?param=1", []string{
+			"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+			"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+		}},
+		{"http://a.b.c.d.e.f.g/1.html", []string{
+			"a.b.c.d.e.f.g/1.html", "a.b.c.d.e.f.g/",
+			"c.d.e.f.g/1.html", "c.d.e.f.g/",
+			"d.e.f.g/1.html", "d.e.f.g/",
+			"e.f.g/1.html", "e.f.g/",
+			"f.g/1.html", "f.g/",
+		}},
+		{"http://1.2.3.4/1/", []string{"1.2.3.4/1/", "1.2.3.4/"}},
+		{"http://a.b.c/1/2/3/4/5/6.html", []string{
+			"a.b.c/1/2/3/4/5/6.html", "a.b.c/", "a.b.c/1/", "a.b.c/1/2/", "a.b.c/1/2/3/",
+			"b.c/1/2/3/4/5/6.html", "b.c/", "b.c/1/", "b.c/1/2/", "b.c/1/2/3/",
+		}},
+		{"http://example.com", []string{"example.com/"}},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[[sha256.Size]byte]bool)
+		for _, sum := range hashExpressions(u.Hostname(), u) {
+			got[sum] = true
+		}
+		want := make(map[[sha256.Size]byte]bool)
+		for _, expression := range tt.expressions {
+			sum := sha256.Sum256([]byte(expression))
+			want[sum] = true
+			if !got[sum] {
+				t.Errorf("hashExpressions(%q) is missing %q", tt.url, expression)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("hashExpressions(%q) returned %d expressions; want %d", tt.url, len(got), len(want))
+		}
+	}
+}
+
+func TestReloadFeeds(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFeed(t, dir, "domains.txt", "evil.example\n")
+	setup(t, func(cfg *config.Config) { cfg.ThreatFeeds = []string{path} })
+
+	if changed, err := ReloadFeeds(); changed || err != nil {
+		t.Errorf("ReloadFeeds of unchanged feeds = %v, %v; want false", changed, err)
+	}
+
+	writeFeed(t, dir, "domains.txt", "evil.example\nworse.example\n")
+	if changed, err := ReloadFeeds(); !changed || err != nil {
+		t.Errorf("ReloadFeeds of a changed feed = %v, %v; want true", changed, err)
+	}
+	if _, blocked := Blocked("https://worse.example/"); !blocked {
+		t.Error("a domain added to a feed is not blocked")
+	}
+
+	// A feed that can't be read keeps its previous entries
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReloadFeeds(); err == nil {
+		t.Error("ReloadFeeds of a missing feed succeeded")
+	}
+	if _, blocked := Blocked("https://evil.example/"); !blocked {
+		t.Error("a feed that failed to reload lost its entries")
+	}
+}
+
+func TestReadHashesRejectsInvalidPrefixes(t *testing.T) {
+	// Not hex, shorter than 4 bytes, longer than a SHA-256
+	for _, line := range []string{"xyz", "abcd", strings.Repeat("ab", sha256.Size+1)} {
+		path := writeFeed(t, t.TempDir(), "bad.hashes", line+"\n")
+		if _, err := loadFeed(path, formatHashes); err == nil {
+			t.Errorf("loadFeed accepted the hash prefix %q", line)
+		}
+	}
+}
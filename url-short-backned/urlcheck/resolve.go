@@ -0,0 +1,161 @@
+package urlcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+	"url-short-backned/metrics"
+)
+
+// Headers of a response are all redirect resolution reads
+const resolveMaxHeaderBytes = 64 << 10
+
+var (
+	resolveClient = &http.Client{
+		Transport: &http.Transport{
+			// A proxy would make the dial check below moot
+			Proxy:                  nil,
+			DialContext:            (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+			TLSHandshakeTimeout:    5 * time.Second,
+			MaxResponseHeaderBytes: resolveMaxHeaderBytes,
+			MaxIdleConns:           10,
+			IdleConnTimeout:        30 * time.Second,
+		},
+		// Hops are followed one at a time below, so each can be checked
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	redirectResolutions = metrics.NewCounterVec("urlshortener_redirect_resolutions_total",
+		"Destinations whose redirect chain was resolved, by result (direct, resolved, rejected or failed).", "result")
+)
+
+// errNonPublicAddr refuses a connection to a non-public address
+var errNonPublicAddr = errors.New("refusing to connect to a non-public address")
+
+// ChainError rejects a destination because of where its redirects lead.
+// Its message is meant for the user.
+type ChainError struct {
+	message string
+}
+
+func (e *ChainError) Error() string {
+	return e.message
+}
+
+// Resolve follows the redirects of a normalised destination and returns
+// where they end. Every hop is checked like a new destination, so a chain
+// that leads back to this service, to a private network or to a site in
+// a threat feed is rejected with a *ChainError, as are loops and chains
+// longer than the hop limit. Other errors mean the chain could not be
+// followed, for example because a server is down.
+func Resolve(ctx context.Context, destination string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, settings.RedirectResolveTimeout)
+	defer cancel()
+
+	final, err := resolve(ctx, destination)
+	var chainErr *ChainError
+	switch {
+	case errors.As(err, &chainErr):
+		redirectResolutions.Inc("rejected")
+	case err != nil:
+		redirectResolutions.Inc("failed")
+	case final == destination:
+		redirectResolutions.Inc("direct")
+	default:
+		redirectResolutions.Inc("resolved")
+	}
+	return final, err
+}
+
+func resolve(ctx context.Context, destination string) (string, error) {
+	current := destination
+	seen := map[string]bool{current: true}
+	for hops := 0; ; hops++ {
+		location, err := nextHop(ctx, current)
+		if err != nil {
+			return "", err
+		}
+		if location == "" {
+			return current, nil
+		}
+		if hops == settings.RedirectMaxHops {
+			return "", &ChainError{fmt.Sprintf("redirects more than %d times", settings.RedirectMaxHops)}
+		}
+
+		next, err := Normalize(location)
+		if err != nil {
+			return "", &ChainError{"redirects to a destination that " + err.Error()}
+		}
+		if _, blocked := Blocked(next); blocked {
+			return "", &ChainError{"redirects to a site reported for malware or phishing"}
+		}
+		if seen[next] {
+			return "", &ChainError{"redirects in a loop"}
+		}
+		seen[next] = true
+		current = next
+	}
+}
+
+// nextHop requests target and returns the absolute URL it redirects to, or
+// "" if it doesn't redirect
+func nextHop(ctx context.Context, target string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "url-shortener-link-check/1.0")
+
+	resp, err := resolveClient.Do(req)
+	if errors.Is(err, errNonPublicAddr) {
+		// A public name can still resolve to an internal address
+		return "", &ChainError{"leads to a private network"}
+	}
+	if err != nil {
+		return "", err
+	}
+	// Only the headers matter, so don't download the body
+	io.CopyN(io.Discard, resp.Body, 4<<10)
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", &ChainError{"redirects without saying where"}
+	}
+	return location.String(), nil
+}
+
+// dialPublicOnly refuses connections to addresses that are not public.
+// It runs after DNS resolution, so names that resolve to internal
+// addresses are caught too, rebinding included.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	if settings.AllowPrivateDestinations {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !IsPublicAddr(addr) {
+		return errNonPublicAddr
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package urlcheck
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"url-short-backned/config"
+)
+
+// redirectServer serves the redirects in routes, by path, and 200 OK for
+// every other path
+func redirectServer(t *testing.T, routes map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location, ok := routes[r.URL.Path]; ok {
+			if location != "" {
+				w.Header().Set("Location", location)
+			}
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolve(t *testing.T) {
+	feed := writeFeed(t, t.TempDir(), "domains.txt", "evil.example\n")
+	setup(t, func(cfg *config.Config) {
+		// The test server listens on loopback
+		cfg.AllowPrivateDestinations = true
+		cfg.RedirectMaxHops = 3
+		cfg.ThreatFeeds = []string{feed}
+	})
+
+	// Every /chain/n redirects to /chain/n+1, forever
+	chain := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		chain["/chain/"+strconv.Itoa(i)] = "/chain/" + strconv.Itoa(i+1)
+	}
+	routes := map[string]string{
+		"/one":         "/two",
+		"/two":         "/three",
+		"/loop/a":      "/loop/b",
+		"/loop/b":      "/loop/a",
+		"/self":        "https://sho.rt/abc",
+		"/evil":        "https://www.evil.example/",
+		"/javascript":  "javascript:alert(1)",
+		"/no-location": "",
+	}
+	for path, location := range chain {
+		routes[path] = location
+	}
+	server := redirectServer(t, routes)
+
+	tests := []struct {
+		path  string
+		final string // Path the chain ends at, if it is accepted
+		err   string
+	}{
+		{"/direct", "/direct", ""},
+		{"/one", "/three", ""},
+		{"/chain/7", "/chain/10", ""},
+		{"/chain/0", "", "redirects more than 3 times"},
+		{"/loop/a", "", "redirects in a loop"},
+		{"/self", "", "redirects to a destination that must not point to this link shortener"},
+		{"/evil", "", "redirects to a site reported for malware or phishing"},
+		{"/javascript", "", "redirects to a destination that must use one of these schemes"},
+		{"/no-location", "", "redirects without saying where"},
+	}
+	for _, tt := range tests {
+		final, err := Resolve(context.Background(), server.URL+tt.path)
+		if tt.err == "" {
+			if err != nil || final != server.URL+tt.final {
+				t.Errorf("Resolve(%s) = %q, %v; want %s", tt.path, final, err, tt.final)
+			}
+			continue
+		}
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("Resolve(%s) = %q, %v; want chain error %q", tt.path, final, err, tt.err)
+		}
+	}
+}
+
+func TestResolveRefusesPrivateAddresses(t *testing.T) {
+	setup(t, nil)
+	server := redirectServer(t, nil)
+
+	// The dial is checked, whatever the destination looked like
+	_, err := Resolve(context.Background(), server.URL+"/")
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) || err.Error() != "leads to a private network" {
+		t.Errorf("Resolve of a loopback server = %v; want a private network chain error", err)
+	}
+}
+
+func TestResolveUnreachable(t *testing.T) {
+	setup(t, func(cfg *config.Config) { cfg.AllowPrivateDestinations = true })
+	server := redirectServer(t, nil)
+	server.Close()
+
+	// A server that is down is not the destination's fault
+	_, err := Resolve(context.Background(), server.URL+"/")
+	var chainErr *ChainError
+	if err == nil || errors.As(err, &chainErr) {
+		t.Errorf("Resolve of a closed server = %v; want a plain error", err)
+	}
+}
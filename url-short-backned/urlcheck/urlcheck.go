@@ -0,0 +1,193 @@
+// Package urlcheck validates and normalises the destinations of new links
+// and checks them against malware and phishing feeds.
+package urlcheck
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"url-short-backned/config"
+
+	"golang.org/x/net/idna"
+)
+
+var settings *config.Config
+
+// ownHost is the host of BaseURL, which links must not point back to
+var ownHost string
+
+// hostProfile converts hosts to their ASCII form the way browsers look
+// them up, checking label and name lengths
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// Domains that only resolve on local networks
+var localSuffixes = []string{"localhost", "local", "localdomain", "internal", "lan", "home.arpa"}
+
+// Init configures the checks and loads the threat feeds. It must be called
+// before any other function in this package.
+func Init(cfg *config.Config) error {
+	settings = cfg
+	if base, err := url.Parse(cfg.BaseURL); err == nil {
+		ownHost, _ = normalizeHost(base.Hostname())
+	}
+	_, err := ReloadFeeds()
+	return err
+}
+
+// Normalize checks that raw is an absolute URL that may be shortened and
+// returns it in normal form: lower-case scheme and host, the host in
+// punycode, no default port and at least a "/" path. Its errors describe
+// what is wrong with raw and are meant to be shown to the user.
+func Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("is required")
+	}
+	if len(raw) > settings.MaxURLLength {
+		return "", fmt.Errorf("must be at most %d characters long", settings.MaxURLLength)
+	}
+	if strings.ContainsFunc(raw, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return "", errors.New("must not contain spaces or control characters")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", errors.New("is not a valid URL")
+	}
+	if u.Scheme == "" {
+		return "", errors.New("must be an absolute URL, such as https://example.com/")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !allowedScheme(u.Scheme) {
+		return "", fmt.Errorf("must use one of these schemes: %s", strings.Join(settings.URLSchemes, ", "))
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", errors.New("must include a host")
+	}
+	if u.User != nil {
+		// https://bank.example@evil.example/ hides the real host
+		return "", errors.New("must not contain a user name or password")
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if !settings.AllowPrivateDestinations {
+		if err := checkPublicHost(host); err != nil {
+			return "", err
+		}
+	}
+	if ownHost != "" && (host == ownHost || strings.HasSuffix(host, "."+ownHost)) {
+		return "", errors.New("must not point to this link shortener")
+	}
+
+	port := u.Port()
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", errors.New("has an invalid port")
+		}
+		if port = strconv.Itoa(n); port == defaultPort(u.Scheme) {
+			port = ""
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// normalizeHost returns a host name in lower-case punycode, or an IP
+// address in its canonical form
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return "", errors.New("must include a host")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Zone() != "" {
+			return "", errors.New("must not use an IPv6 zone")
+		}
+		return addr.Unmap().String(), nil
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil {
+		return "", errors.New("has an invalid host name")
+	}
+	ascii = strings.ToLower(ascii)
+
+	// Browsers read a name ending in a number as an IPv4 address in
+	// decimal, octal or hex, such as 0x7f.1
+	labels := strings.Split(ascii, ".")
+	if numericLabel(labels[len(labels)-1]) {
+		return "", errors.New("has an invalid IP address")
+	}
+	return ascii, nil
+}
+
+// checkPublicHost rejects hosts that can only be reached on a local
+// network. Names are not resolved: what they resolve to can change after
+// the check, so fetches made later check the addresses they connect to.
+func checkPublicHost(host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !IsPublicAddr(addr) {
+			return errors.New("must not point to a private network")
+		}
+		return nil
+	}
+	if !strings.Contains(host, ".") {
+		return errors.New("must use a fully qualified domain name")
+	}
+	for _, suffix := range localSuffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return errors.New("must not point to a private network")
+		}
+	}
+	return nil
+}
+
+func allowedScheme(scheme string) bool {
+	for _, allowed := range settings.URLSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	case "ftp":
+		return "21"
+	}
+	return ""
+}
+
+func numericLabel(label string) bool {
+	if label == "" {
+		return false
+	}
+	if hex, ok := strings.CutPrefix(label, "0x"); ok {
+		_, err := strconv.ParseUint("0"+hex, 16, 64)
+		return err == nil
+	}
+	_, err := strconv.ParseUint(label, 10, 64)
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is a set that answers "definitely not present" or "maybe
+// present". False positives happen at the rate it was sized for, false
+// negatives never do. It is not safe for concurrent use.
+type BloomFilter struct {
+	bits   []uint64
+	size   uint64 // Number of bits
+	hashes uint64
+}
+
+// NewBloomFilter returns a filter sized to hold expected elements with the
+// given false positive rate
+func NewBloomFilter(expected int, falsePositiveRate float64) *BloomFilter {
+	n := math.Max(float64(expected), 1)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(math.Round(m/n*math.Ln2), 1)
+
+	size := uint64(m)
+	return &BloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: uint64(k)}
+}
+
+// Add inserts s
+func (b *BloomFilter) Add(s string) {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain reports whether s may have been added. False means it
+// definitely wasn't.
+func (b *BloomFilter) MayContain(s string) bool {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.size
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the two hashes combined into the filter's k hashes
+// (Kirsch and Mitzenmacher's double hashing)
+func bloomHashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	h1 := h.Sum64()
+
+	// Mix h1 into an independent-looking second hash (splitmix64 finaliser)
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ h2>>30) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ h2>>27) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
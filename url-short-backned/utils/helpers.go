@@ -1,17 +1,20 @@
 package utils
 
 import (
-	"math/rand"
-	"time"
+	"math/rand/v2"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-?/"
+// Short codes only use characters that need no escaping in a URL path
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// ShortURLLength is the length of generated short codes. Fixed paths such
+// as /healthz are shorter, so they can never be generated.
+const ShortURLLength = 8
 
 func GenerateShortURL() string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]byte, 8)
+	b := make([]byte, ShortURLLength)
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		b[i] = letterBytes[rand.IntN(len(letterBytes))]
 	}
 	return string(b)
 }
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// 2^12 one-byte registers give a standard error of about 1.6% while
+// keeping each stored sketch at 4KB
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// HyperLogLog is an approximate distinct counter. Sketches with the same
+// precision can be merged, so daily sketches can be combined into a count
+// for any date range.
+type HyperLogLog struct {
+	registers []byte
+}
+
+// NewHyperLogLog returns an empty sketch
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]byte, hllRegisters)}
+}
+
+// HyperLogLogFromBytes restores a sketch previously serialised with Bytes
+func HyperLogLogFromBytes(data []byte) (*HyperLogLog, error) {
+	if len(data) != hllRegisters {
+		return nil, errors.New("invalid HyperLogLog sketch size")
+	}
+	registers := make([]byte, hllRegisters)
+	copy(registers, data)
+	return &HyperLogLog{registers: registers}, nil
+}
+
+// Add records a 64-bit hash of an element in the sketch
+func (h *HyperLogLog) Add(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	// Set a sentinel bit so the rank is capped for all-zero remainders
+	remainder := hash<<hllPrecision | 1<<(hllPrecision-1)
+	rank := byte(bits.LeadingZeros64(remainder) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge folds another sketch into h
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// Count returns the estimated number of distinct elements added
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+
+	// Use linear counting for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// Bytes returns the sketch registers for storage
+func (h *HyperLogLog) Bytes() []byte {
+	data := make([]byte, len(h.registers))
+	copy(data, h.registers)
+	return data
+}
+
+// VisitorHash returns a salted hash identifying a visitor by IP address and
+// user agent, without storing either in the sketch
+func VisitorHash(salt, ip, userAgent string) uint64 {
+	sum := sha256.Sum256([]byte(salt + "\x00" + ip + "\x00" + userAgent))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// AnonymizeIP zeroes the host part of an IP address, keeping the first
+// three octets of an IPv4 address and the first 48 bits of an IPv6 one.
+// Values that are not IP addresses are dropped.
+func AnonymizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// DoNotTrack reports whether the request opted out of tracking with the
+// DNT or Sec-GPC header
+func DoNotTrack(r *http.Request) bool {
+	// Canonical keys, so the lookups don't allocate
+	return r.Header.Get("Dnt") == "1" || r.Header.Get("Sec-Gpc") == "1"
+}
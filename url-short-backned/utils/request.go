@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client that sent the request.
+// When the request comes from a trusted proxy, the address is taken from
+// X-Forwarded-For instead: the rightmost entry not added by a trusted
+// proxy, since anything left of it could have been made up by the client.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !IsTrustedProxy(host, trustedProxies) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hops := strings.Split(forwarded[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop := strings.TrimSpace(hops[j])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				// Garbage from the client: the last proxy is the best we have
+				return host
+			}
+			host = hop
+			if !IsTrustedProxy(hop, trustedProxies) {
+				return hop
+			}
+		}
+	}
+	return host
+}
+
+// IsTrustedProxy reports whether ip is in one of the trusted proxy ranges
+func IsTrustedProxy(ip string, trustedProxies []netip.Prefix) bool {
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
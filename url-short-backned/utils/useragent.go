@@ -0,0 +1,206 @@
+package utils
+
+import "strings"
+
+// Bot categories reported for non-human traffic
+const (
+	BotCategoryCrawler = "crawler"
+	BotCategoryPreview = "preview"
+	BotCategoryMonitor = "monitor"
+	BotCategoryLibrary = "library"
+)
+
+// Device classes reported for a parsed user agent
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceUnknown = "unknown"
+)
+
+// UserAgent holds the parsed details of a User-Agent header
+type UserAgent struct {
+	Browser     string
+	OS          string
+	Device      string
+	IsBot       bool
+	BotName     string
+	BotCategory string
+}
+
+type botSignature struct {
+	token    string
+	name     string
+	category string
+}
+
+// Known bots, matched in order against the lower-cased user agent.
+// Link-preview fetchers come first because several of them also
+// contain generic words like "bot" that would match a crawler entry.
+var botSignatures = []botSignature{
+	// Link-preview fetchers
+	{"slackbot-linkexpanding", "Slackbot", BotCategoryPreview},
+	{"slack-imgproxy", "Slackbot", BotCategoryPreview},
+	{"slackbot", "Slackbot", BotCategoryPreview},
+	{"twitterbot", "Twitterbot", BotCategoryPreview},
+	{"facebookexternalhit", "Facebook", BotCategoryPreview},
+	{"facebookcatalog", "Facebook", BotCategoryPreview},
+	{"meta-externalagent", "Facebook", BotCategoryPreview},
+	{"linkedinbot", "LinkedInBot", BotCategoryPreview},
+	{"discordbot", "Discordbot", BotCategoryPreview},
+	{"telegrambot", "TelegramBot", BotCategoryPreview},
+	{"whatsapp", "WhatsApp", BotCategoryPreview},
+	{"skypeuripreview", "Skype", BotCategoryPreview},
+	{"pinterestbot", "Pinterest", BotCategoryPreview},
+	{"redditbot", "Redditbot", BotCategoryPreview},
+	{"embedly", "Embedly", BotCategoryPreview},
+	{"iframely", "Iframely", BotCategoryPreview},
+	{"vkshare", "VKShare", BotCategoryPreview},
+	{"mastodon", "Mastodon", BotCategoryPreview},
+	{"google-pagerenderer", "Google Preview", BotCategoryPreview},
+
+	// Uptime and synthetic monitoring
+	{"uptimerobot", "UptimeRobot", BotCategoryMonitor},
+	{"pingdom", "Pingdom", BotCategoryMonitor},
+	{"statuscake", "StatusCake", BotCategoryMonitor},
+	{"site24x7", "Site24x7", BotCategoryMonitor},
+	{"betteruptime", "Better Uptime", BotCategoryMonitor},
+	{"better uptime", "Better Uptime", BotCategoryMonitor},
+	{"newrelicpinger", "New Relic", BotCategoryMonitor},
+	{"datadogsynthetics", "Datadog", BotCategoryMonitor},
+	{"checkly", "Checkly", BotCategoryMonitor},
+	{"freshping", "Freshping", BotCategoryMonitor},
+	{"hetrixtools", "HetrixTools", BotCategoryMonitor},
+	{"updown.io", "updown.io", BotCategoryMonitor},
+
+	// Search engines and other crawlers
+	{"googlebot", "Googlebot", BotCategoryCrawler},
+	{"adsbot-google", "Googlebot", BotCategoryCrawler},
+	{"bingbot", "Bingbot", BotCategoryCrawler},
+	{"yandexbot", "YandexBot", BotCategoryCrawler},
+	{"baiduspider", "Baiduspider", BotCategoryCrawler},
+	{"duckduckbot", "DuckDuckBot", BotCategoryCrawler},
+	{"applebot", "Applebot", BotCategoryCrawler},
+	{"ahrefsbot", "AhrefsBot", BotCategoryCrawler},
+	{"semrushbot", "SemrushBot", BotCategoryCrawler},
+	{"mj12bot", "MJ12bot", BotCategoryCrawler},
+	{"petalbot", "PetalBot", BotCategoryCrawler},
+	{"gptbot", "GPTBot", BotCategoryCrawler},
+	{"ccbot", "CCBot", BotCategoryCrawler},
+	{"bytespider", "Bytespider", BotCategoryCrawler},
+	{"headlesschrome", "HeadlessChrome", BotCategoryCrawler},
+
+	// HTTP client libraries and command-line tools
+	{"curl/", "curl", BotCategoryLibrary},
+	{"wget/", "Wget", BotCategoryLibrary},
+	{"python-requests", "python-requests", BotCategoryLibrary},
+	{"python-urllib", "Python urllib", BotCategoryLibrary},
+	{"aiohttp", "aiohttp", BotCategoryLibrary},
+	{"go-http-client", "Go http client", BotCategoryLibrary},
+	{"java/", "Java", BotCategoryLibrary},
+	{"libwww-perl", "libwww-perl", BotCategoryLibrary},
+	{"axios/", "axios", BotCategoryLibrary},
+	{"node-fetch", "node-fetch", BotCategoryLibrary},
+	{"httpie", "HTTPie", BotCategoryLibrary},
+	{"postmanruntime", "Postman", BotCategoryLibrary},
+
+	// Generic markers, checked last. "bot" is only matched as the end of
+	// a product token, since device names such as Cubot contain it too.
+	{"bot/", "Other bot", BotCategoryCrawler},
+	{"bot;", "Other bot", BotCategoryCrawler},
+	{"crawler", "Other bot", BotCategoryCrawler},
+	{"spider", "Other bot", BotCategoryCrawler},
+}
+
+// ParseUserAgent extracts the browser, OS and device class from a
+// User-Agent header and flags known bots
+func ParseUserAgent(header string) UserAgent {
+	ua := strings.ToLower(strings.TrimSpace(header))
+
+	// Real browsers always send a user agent
+	if ua == "" {
+		return UserAgent{
+			Browser:     "Unknown",
+			OS:          "Unknown",
+			Device:      DeviceBot,
+			IsBot:       true,
+			BotName:     "Unknown",
+			BotCategory: BotCategoryLibrary,
+		}
+	}
+
+	parsed := UserAgent{
+		Browser: parseBrowser(ua),
+		OS:      parseOS(ua),
+		Device:  parseDevice(ua),
+	}
+
+	for _, sig := range botSignatures {
+		if strings.Contains(ua, sig.token) {
+			parsed.IsBot = true
+			parsed.BotName = sig.name
+			parsed.BotCategory = sig.category
+			parsed.Device = DeviceBot
+			break
+		}
+	}
+
+	return parsed
+}
+
+func parseBrowser(ua string) string {
+	switch {
+	case strings.Contains(ua, "edg/"), strings.Contains(ua, "edge/"),
+		strings.Contains(ua, "edga/"), strings.Contains(ua, "edgios/"):
+		return "Edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		return "Opera"
+	case strings.Contains(ua, "samsungbrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "firefox/"), strings.Contains(ua, "fxios/"):
+		return "Firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		return "Chrome"
+	case strings.Contains(ua, "safari/") && strings.Contains(ua, "version/"):
+		return "Safari"
+	case strings.Contains(ua, "msie "), strings.Contains(ua, "trident/"):
+		return "Internet Explorer"
+	default:
+		return "Other"
+	}
+}
+
+func parseOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return "iOS"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "cros "):
+		return "ChromeOS"
+	case strings.Contains(ua, "mac os x"), strings.Contains(ua, "macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	default:
+		return "Other"
+	}
+}
+
+func parseDevice(ua string) string {
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"):
+		return DeviceMobile
+	case strings.Contains(ua, "windows"), strings.Contains(ua, "macintosh"),
+		strings.Contains(ua, "x11"), strings.Contains(ua, "cros "), strings.Contains(ua, "linux"):
+		return DeviceDesktop
+	default:
+		return DeviceUnknown
+	}
+}
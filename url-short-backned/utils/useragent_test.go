@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	uaChromeWindows  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaEdgeWindows    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91"
+	uaFirefoxLinux   = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	uaSafariMac      = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15"
+	uaSafariIPhone   = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1"
+	uaSafariIPad     = "Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1"
+	uaChromeAndroid  = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36"
+	uaSamsungTablet  = "Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36"
+	uaOperaWindows   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 OPR/106.0.0.0"
+	uaChromeOS       = "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaIE11           = "Mozilla/5.0 (Windows NT 10.0; WOW64; Trident/7.0; rv:11.0) like Gecko"
+	uaOfficeMac      = "Microsoft Office/16.0 (Macintosh; Mac OS X 14.2; Microsoft Outlook 16.80.23121017; Pro)"
+	uaCubot          = "Mozilla/5.0 (Linux; Android 10; CUBOT X30 Build/QP1A.190711.020) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36"
+	uaGooglebot      = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	uaSlackbot       = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+	uaTwitterbot     = "Twitterbot/1.0"
+	uaFacebook       = "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)"
+	uaUptimeRobot    = "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)"
+	uaCurl           = "curl/8.4.0"
+	uaPythonRequests = "python-requests/2.31.0"
+	uaUnknownBot     = "Mozilla/5.0 (compatible; ExampleBot/1.0; +https://example.com/bot)"
+	uaUnknownBotSemi = "Mozilla/5.0 (compatible; examplebot; +https://example.com/)"
+	uaSpider         = "Sogou web spider/4.0(+http://www.sogou.com/docs/help/webmasters.htm#07)"
+)
+
+func TestParseBrowser(t *testing.T) {
+	tests := []struct {
+		ua, want string
+	}{
+		{uaChromeWindows, "Chrome"},
+		{uaEdgeWindows, "Edge"},
+		{uaFirefoxLinux, "Firefox"},
+		{uaSafariMac, "Safari"},
+		{uaSafariIPhone, "Safari"},
+		{uaChromeAndroid, "Chrome"},
+		{uaSamsungTablet, "Samsung Internet"},
+		{uaOperaWindows, "Opera"},
+		{uaIE11, "Internet Explorer"},
+		{uaOfficeMac, "Other"},
+		{uaCurl, "Other"},
+	}
+	for _, tt := range tests {
+		if got := parseBrowser(strings.ToLower(tt.ua)); got != tt.want {
+			t.Errorf("parseBrowser(%q) = %q; want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestParseOS(t *testing.T) {
+	tests := []struct {
+		ua, want string
+	}{
+		{uaChromeWindows, "Windows"},
+		{uaFirefoxLinux, "Linux"},
+		{uaSafariMac, "macOS"},
+		{uaSafariIPhone, "iOS"},
+		{uaSafariIPad, "iOS"},
+		{uaChromeAndroid, "Android"},
+		{uaChromeOS, "ChromeOS"},
+		// "cros" appears inside "microsoft" and "macros"
+		{uaOfficeMac, "macOS"},
+		{uaCurl, "Other"},
+	}
+	for _, tt := range tests {
+		if got := parseOS(strings.ToLower(tt.ua)); got != tt.want {
+			t.Errorf("parseOS(%q) = %q; want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		ua, want string
+	}{
+		{uaChromeWindows, DeviceDesktop},
+		{uaFirefoxLinux, DeviceDesktop},
+		{uaSafariMac, DeviceDesktop},
+		{uaChromeOS, DeviceDesktop},
+		{uaOfficeMac, DeviceDesktop},
+		{uaSafariIPhone, DeviceMobile},
+		{uaChromeAndroid, DeviceMobile},
+		{uaCubot, DeviceMobile},
+		{uaSafariIPad, DeviceTablet},
+		{uaSamsungTablet, DeviceTablet},
+		{uaCurl, DeviceUnknown},
+	}
+	for _, tt := range tests {
+		if got := parseDevice(strings.ToLower(tt.ua)); got != tt.want {
+			t.Errorf("parseDevice(%q) = %q; want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestParseUserAgentBots(t *testing.T) {
+	tests := []struct {
+		ua       string
+		name     string
+		category string
+	}{
+		{uaGooglebot, "Googlebot", BotCategoryCrawler},
+		{uaSlackbot, "Slackbot", BotCategoryPreview},
+		{uaTwitterbot, "Twitterbot", BotCategoryPreview},
+		{uaFacebook, "Facebook", BotCategoryPreview},
+		{uaUptimeRobot, "UptimeRobot", BotCategoryMonitor},
+		{uaCurl, "curl", BotCategoryLibrary},
+		{uaPythonRequests, "python-requests", BotCategoryLibrary},
+		{uaUnknownBot, "Other bot", BotCategoryCrawler},
+		{uaUnknownBotSemi, "Other bot", BotCategoryCrawler},
+		{uaSpider, "Other bot", BotCategoryCrawler},
+		{"", "Unknown", BotCategoryLibrary},
+	}
+	for _, tt := range tests {
+		parsed := ParseUserAgent(tt.ua)
+		if !parsed.IsBot || parsed.BotName != tt.name || parsed.BotCategory != tt.category || parsed.Device != DeviceBot {
+			t.Errorf("ParseUserAgent(%q) = %+v; want bot %q in %q", tt.ua, parsed, tt.name, tt.category)
+		}
+	}
+}
+
+func TestParseUserAgentHumans(t *testing.T) {
+	for _, ua := range []string{
+		uaChromeWindows, uaEdgeWindows, uaFirefoxLinux, uaSafariMac, uaSafariIPhone,
+		uaSafariIPad, uaChromeAndroid, uaSamsungTablet, uaChromeOS, uaOfficeMac,
+		// Device names may contain "bot"
+		uaCubot,
+	} {
+		if parsed := ParseUserAgent(ua); parsed.IsBot {
+			t.Errorf("ParseUserAgent(%q) flagged a browser as %q", ua, parsed.BotName)
+		}
+	}
+}